@@ -14,7 +14,7 @@ func main() {
 		fmt.Println(err)
 		return
 	}
-	reader, _, _ := process.ProcessObject(bytes.NewReader(buf), "image/sharpen,100")
+	reader, _ := process.ProcessObject(bytes.NewReader(buf), "", "image/sharpen,100", nil)
 	if reader == nil {
 		fmt.Println("process error")
 		return
@@ -0,0 +1,258 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+)
+
+func AutoLevelsImage(buffer []byte, clipPercent *float64, simpleType string) []byte {
+	p := defAutoLevelsClip
+	if clipPercent != nil {
+		p = *clipPercent
+	}
+	return _autoAdjustImageBuffer(buffer, simpleType, func(img *image.NRGBA) {
+		// each channel is stretched on its own, which also removes color casts
+		var hist [3][256]int
+		total := _computeHistogram(img, func(r, g, b uint8) {
+			hist[0][r] += 1
+			hist[1][g] += 1
+			hist[2][b] += 1
+		})
+		var maps [3][256]uint8
+		for k := range hist {
+			low := _histogramPercentile(hist[k], total, p)
+			high := _histogramPercentile(hist[k], total, 100-p)
+			maps[k] = _stretchMap(low, high)
+		}
+		_mapImagePixels(img, func(r, g, b uint8) (uint8, uint8, uint8) {
+			return maps[0][r], maps[1][g], maps[2][b]
+		})
+	})
+}
+
+func AutoContrastImage(buffer []byte, clipPercent *float64, simpleType string) []byte {
+	p := defAutoLevelsClip
+	if clipPercent != nil {
+		p = *clipPercent
+	}
+	return _autoAdjustImageBuffer(buffer, simpleType, func(img *image.NRGBA) {
+		// one stretch for all channels based on luminance, so hue is kept
+		var hist [256]int
+		total := _computeHistogram(img, func(r, g, b uint8) {
+			l := _computeLuma(float64(r), float64(g), float64(b))
+			hist[_fixColor(int32(math.Round(l)))] += 1
+		})
+		m := _stretchMap(_histogramPercentile(hist, total, p), _histogramPercentile(hist, total, 100-p))
+		_mapImagePixels(img, func(r, g, b uint8) (uint8, uint8, uint8) {
+			return m[r], m[g], m[b]
+		})
+	})
+}
+
+func EqualizeImage(buffer []byte, adaptive bool, tileCount *int64, clipLimit *float64, simpleType string) []byte {
+	tiles := defEqualizeTiles
+	limit := defEqualizeClipLimit
+	if tileCount != nil {
+		tiles = int(*tileCount)
+	}
+	if clipLimit != nil {
+		limit = *clipLimit
+	}
+	return _autoAdjustImageBuffer(buffer, simpleType, func(img *image.NRGBA) {
+		_equalizeLightness(img, adaptive, tiles, limit)
+	})
+}
+
+func _autoAdjustImageBuffer(buffer []byte, simpleType string, fn func(img *image.NRGBA)) []byte {
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	img := _toNRGBA(imgSrc)
+	fn(img)
+
+	return _saveImage(buffer, img, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+// _computeHistogram visits the colors of the visible pixels and returns their count
+func _computeHistogram(img *image.NRGBA, fn func(r, g, b uint8)) int {
+	total := 0
+	bounds := img.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			i := y*img.Stride + x*4
+			if img.Pix[i+3] == 0 {
+				continue
+			}
+			fn(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+			total += 1
+		}
+	}
+	return total
+}
+
+func _mapImagePixels(img *image.NRGBA, fn func(r, g, b uint8) (uint8, uint8, uint8)) {
+	bounds := img.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			i := y*img.Stride + x*4
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2] = fn(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		}
+	}
+}
+
+// _histogramPercentile returns the smallest value with at least p percent of the samples at or below it
+func _histogramPercentile(hist [256]int, total int, p float64) int {
+	target := float64(total) * p / 100
+	sum := 0
+	for v := range hist {
+		sum += hist[v]
+		if float64(sum) >= target && sum > 0 {
+			return v
+		}
+	}
+	return 255
+}
+
+func _stretchMap(low, high int) [256]uint8 {
+	var m [256]uint8
+	for v := range m {
+		if high <= low {
+			m[v] = uint8(v)
+			continue
+		}
+		m[v] = _fixColor(int32(math.Round(float64(v-low) * 255 / float64(high-low))))
+	}
+	return m
+}
+
+// _equalizeLightness equalizes the Lab lightness, globally or per tile with contrast limiting (CLAHE)
+func _equalizeLightness(img *image.NRGBA, adaptive bool, tiles int, clipLimit float64) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	if width == 0 || height == 0 {
+		return
+	}
+
+	// lightness quantized to 256 levels, and the color to put back
+	levels := make([]uint8, width*height)
+	labA := make([]float64, width*height)
+	labB := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*img.Stride + x*4
+			l, a, b := _rgbToLab(float64(img.Pix[i])/255, float64(img.Pix[i+1])/255, float64(img.Pix[i+2])/255)
+			j := y*width + x
+			levels[j] = _fixColor(int32(math.Round(l * 2.55)))
+			labA[j] = a
+			labB[j] = b
+		}
+	}
+
+	if !adaptive {
+		tiles = 1
+	}
+	tilesX := int(math.Max(1, math.Min(float64(tiles), float64(width))))
+	tilesY := int(math.Max(1, math.Min(float64(tiles), float64(height))))
+	tileW := float64(width) / float64(tilesX)
+	tileH := float64(height) / float64(tilesY)
+
+	maps := make([][256]float64, tilesX*tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			var hist [256]int
+			total := 0
+			for y := int(float64(ty) * tileH); y < int(float64(ty+1)*tileH); y++ {
+				for x := int(float64(tx) * tileW); x < int(float64(tx+1)*tileW); x++ {
+					if img.Pix[y*img.Stride+x*4+3] == 0 {
+						continue
+					}
+					hist[levels[y*width+x]] += 1
+					total += 1
+				}
+			}
+			if adaptive {
+				_clipHistogram(&hist, total, clipLimit)
+			}
+			maps[ty*tilesX+tx] = _equalizeMap(hist, total)
+		}
+	}
+
+	for y := 0; y < height; y++ {
+		// interpolate between the mappings of the four nearest tile centers
+		fY := (float64(y)+0.5)/tileH - 0.5
+		y0 := int(math.Max(0, math.Floor(fY)))
+		y1 := int(math.Min(float64(tilesY-1), float64(y0+1)))
+		wY := math.Max(0, math.Min(1, fY-float64(y0)))
+		for x := 0; x < width; x++ {
+			i := y*img.Stride + x*4
+			if img.Pix[i+3] == 0 {
+				continue
+			}
+			fX := (float64(x)+0.5)/tileW - 0.5
+			x0 := int(math.Max(0, math.Floor(fX)))
+			x1 := int(math.Min(float64(tilesX-1), float64(x0+1)))
+			wX := math.Max(0, math.Min(1, fX-float64(x0)))
+
+			j := y*width + x
+			v := levels[j]
+			l := (maps[y0*tilesX+x0][v]*(1-wX)+maps[y0*tilesX+x1][v]*wX)*(1-wY) +
+				(maps[y1*tilesX+x0][v]*(1-wX)+maps[y1*tilesX+x1][v]*wX)*wY
+			r, g, b := _labToRgb(l, labA[j], labB[j])
+			img.Pix[i] = _fixColor(int32(math.Round(r * 255)))
+			img.Pix[i+1] = _fixColor(int32(math.Round(g * 255)))
+			img.Pix[i+2] = _fixColor(int32(math.Round(b * 255)))
+		}
+	}
+}
+
+// _clipHistogram limits each bin to clipLimit times the average and spreads the excess evenly
+func _clipHistogram(hist *[256]int, total int, clipLimit float64) {
+	limit := int(math.Max(1, clipLimit*float64(total)/256))
+	excess := 0
+	for v := range hist {
+		if hist[v] > limit {
+			excess += hist[v] - limit
+			hist[v] = limit
+		}
+	}
+	for v := range hist {
+		hist[v] += excess / 256
+	}
+	for v := 0; v < excess%256; v++ {
+		hist[v*256/(excess%256)] += 1
+	}
+}
+
+// _equalizeMap maps each level to a lightness in [0, 100] following the cumulative histogram
+func _equalizeMap(hist [256]int, total int) [256]float64 {
+	var m [256]float64
+	cdfMin := 0
+	for v := range hist {
+		if hist[v] > 0 {
+			cdfMin = hist[v]
+			break
+		}
+	}
+	sum := 0
+	for v := range hist {
+		sum += hist[v]
+		if total <= cdfMin {
+			m[v] = float64(v) / 2.55
+			continue
+		}
+		m[v] = math.Max(0, float64(sum-cdfMin)) / float64(total-cdfMin) * 100
+	}
+	return m
+}
@@ -0,0 +1,120 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+func BlurImage(buffer []byte, blurRadius, blurSigma *int64, simpleType string) []byte {
+	if blurRadius == nil && blurSigma == nil {
+		return buffer
+	}
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	radius := defBlurRadius
+	sigma := float64(defBlurSigma)
+	if blurRadius != nil {
+		radius = int(*blurRadius)
+	}
+	if blurSigma != nil {
+		sigma = float64(*blurSigma)
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	blurImg := _gaussianBlur(_toRGBA(imgSrc), radius, sigma)
+
+	return _saveImage(buffer, blurImg, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+// _gaussianBlur separable gaussian blur on premultiplied pixels, edges are clamped
+func _gaussianBlur(src *image.RGBA, radius int, sigma float64) *image.RGBA {
+	bounds := src.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if radius < 1 || sigma <= 0 || width == 0 || height == 0 {
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+		return dst
+	}
+
+	kernel := _gaussianKernel(radius, sigma)
+
+	// horizontal pass keeps full precision for the vertical pass
+	tmp := make([]float64, width*height*4)
+	for y := 0; y < height; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x := 0; x < width; x++ {
+			var c [4]float64
+			for k := -radius; k <= radius; k++ {
+				sX := x + k
+				if sX < 0 {
+					sX = 0
+				} else if sX >= width {
+					sX = width - 1
+				}
+				w := kernel[k+radius]
+				p := row[sX*4 : sX*4+4 : sX*4+4]
+				c[0] += float64(p[0]) * w
+				c[1] += float64(p[1]) * w
+				c[2] += float64(p[2]) * w
+				c[3] += float64(p[3]) * w
+			}
+			i := (y*width + x) * 4
+			copy(tmp[i:i+4], c[:])
+		}
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c [4]float64
+			for k := -radius; k <= radius; k++ {
+				sY := y + k
+				if sY < 0 {
+					sY = 0
+				} else if sY >= height {
+					sY = height - 1
+				}
+				w := kernel[k+radius]
+				i := (sY*width + x) * 4
+				c[0] += tmp[i] * w
+				c[1] += tmp[i+1] * w
+				c[2] += tmp[i+2] * w
+				c[3] += tmp[i+3] * w
+			}
+			d := y*dst.Stride + x*4
+			a := math.Min(255, math.Round(c[3]))
+			dst.Pix[d] = uint8(math.Min(a, math.Round(c[0])))
+			dst.Pix[d+1] = uint8(math.Min(a, math.Round(c[1])))
+			dst.Pix[d+2] = uint8(math.Min(a, math.Round(c[2])))
+			dst.Pix[d+3] = uint8(a)
+		}
+	}
+	return dst
+}
+
+func _gaussianKernel(radius int, sigma float64) []float64 {
+	kernel := make([]float64, radius*2+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
@@ -0,0 +1,173 @@
+package process
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nfnt/resize"
+	"github.com/ultimate-guitar/go-imagequant"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// imagePaletteColor
+type imagePaletteColor struct {
+	RGB   string  `json:"RGB"`
+	Ratio float64 `json:"Ratio"`
+}
+
+// AverageHueImage returns the average color as JSON, false when the image can't be read and the buffer is returned
+// as it is
+func AverageHueImage(buffer []byte, simpleType string) ([]byte, bool) {
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer, false
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer, false
+	}
+
+	// weighted by alpha, so transparent pixels do not pull the average to black
+	bounds := imgSrc.Bounds()
+	var sumR, sumG, sumB, sumA float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := imgSrc.At(x, y).RGBA()
+			sumR += float64(r)
+			sumG += float64(g)
+			sumB += float64(b)
+			sumA += float64(a)
+		}
+	}
+	col := color.RGBA{}
+	if sumA > 0 {
+		col.R = uint8(math.Round(sumR / sumA * 255))
+		col.G = uint8(math.Round(sumG / sumA * 255))
+		col.B = uint8(math.Round(sumB / sumA * 255))
+	}
+
+	result, err := json.Marshal(map[string]string{
+		"RGB": _formatRGBHex(col),
+	})
+	if err != nil {
+		fmt.Println(err)
+		return buffer, false
+	}
+	return result, true
+}
+
+// PaletteImage returns the dominant colors as JSON, false when the image can't be read and the buffer is returned
+// as it is
+func PaletteImage(buffer []byte, colorCount *int64, simpleType string) ([]byte, bool) {
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer, false
+	}
+
+	n := defPaletteColorCount
+	if colorCount != nil {
+		n = int(math.Max(2, math.Min(32, float64(*colorCount))))
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer, false
+	}
+
+	// dominant colors do not need every pixel
+	imgSrc = resize.Thumbnail(defPaletteSampleSize, defPaletteSampleSize, imgSrc, resize.Bilinear)
+
+	colors, err := _extractPalette(imgSrc, n)
+	if err != nil {
+		fmt.Println(err)
+		return buffer, false
+	}
+
+	result, err := json.Marshal(map[string][]imagePaletteColor{
+		"Colors": colors,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return buffer, false
+	}
+	return result, true
+}
+
+func _extractPalette(imgSrc image.Image, n int) ([]imagePaletteColor, error) {
+	bounds := imgSrc.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	attr, err := imagequant.NewAttributes()
+	if err != nil {
+		return nil, err
+	}
+	defer attr.Release()
+	_ = attr.SetSpeed(5)
+	_ = attr.SetQuality(0, 100)
+	if err = attr.SetMaxColors(n); err != nil {
+		return nil, err
+	}
+	rgba32data := string(imagequant.ImageToRgba32(imgSrc))
+	iqm, err := imagequant.NewImage(attr, rgba32data, width, height, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer iqm.Release()
+	quantizeRes, err := iqm.Quantize(attr)
+	if err != nil {
+		return nil, err
+	}
+	defer quantizeRes.Release()
+	rgb8data, err := quantizeRes.WriteRemappedImage()
+	if err != nil {
+		return nil, err
+	}
+	pal := quantizeRes.GetPalette()
+
+	counts := make([]int, len(pal))
+	total := 0
+	for i := range rgb8data {
+		index := int(rgb8data[i])
+		if index >= len(pal) {
+			continue
+		}
+		if _, _, _, a := pal[index].RGBA(); a < 0x8000 { // mostly transparent
+			continue
+		}
+		counts[index] += 1
+		total += 1
+	}
+
+	var colors []imagePaletteColor
+	indexes := make([]int, len(pal))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return counts[indexes[i]] > counts[indexes[j]]
+	})
+	for _, index := range indexes {
+		if counts[index] == 0 {
+			break
+		}
+		col := color.NRGBAModel.Convert(pal[index]).(color.NRGBA)
+		colors = append(colors, imagePaletteColor{
+			RGB:   _formatRGBHex(color.RGBA{R: col.R, G: col.G, B: col.B, A: 255}),
+			Ratio: math.Round(float64(counts[index])/float64(total)*10000) / 10000,
+		})
+	}
+	return colors, nil
+}
+
+func _formatRGBHex(col color.RGBA) string {
+	return fmt.Sprintf("0x%02x%02x%02x", col.R, col.G, col.B)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"math"
 )
 
 func BrightImage(buffer []byte, brightValue *int64, simpleType string) []byte {
@@ -12,54 +13,136 @@ func BrightImage(buffer []byte, brightValue *int64, simpleType string) []byte {
 		return buffer
 	}
 
-	v := int32(*brightValue)
+	v := float64(*brightValue) / 255
 	if v == 0 {
 		return buffer
 	}
 
-	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		return r + v, g + v, b + v
+	})
+}
 
-	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+func ContrastImage(buffer []byte, contrastValue *int64, simpleType string) []byte {
+	if contrastValue == nil {
 		return buffer
 	}
 
-	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
-	if err != nil {
-		fmt.Println(err)
+	v := float64(*contrastValue) / 255
+	if v == 0 {
 		return buffer
 	}
 
-	bounds := imgSrc.Bounds()
-	sW := bounds.Dx()
-	sH := bounds.Dy()
+	t := float64(defContrastThreshold) / 255
 
-	rgbImg := image.NewRGBA(bounds)
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		return _computeContrast(r, t, v), _computeContrast(g, t, v), _computeContrast(b, t, v)
+	})
+}
 
-	for y := 0; y < sH; y++ {
-		for x := 0; x < sW; x++ {
-			r, g, b, a := imgSrc.At(x, y).RGBA()
-			rgbImg.SetRGBA(x, y, color.RGBA{
-				A: _fixColor(int32(a)),
-				R: _fixColor(int32(r>>8) + v),
-				G: _fixColor(int32(g>>8) + v),
-				B: _fixColor(int32(b>>8) + v),
-			})
+func _computeContrast(col float64, th float64, con float64) float64 {
+	return col + (col-th)*con
+}
+
+func GrayscaleImage(buffer []byte, simpleType string) []byte {
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		l := _computeLuma(r, g, b)
+		return l, l, l
+	})
+}
+
+func SepiaImage(buffer []byte, simpleType string) []byte {
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		return 0.393*r + 0.769*g + 0.189*b, 0.349*r + 0.686*g + 0.168*b, 0.272*r + 0.534*g + 0.131*b
+	})
+}
+
+func InvertImage(buffer []byte, simpleType string) []byte {
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		return 1 - r, 1 - g, 1 - b
+	})
+}
+
+func ThresholdImage(buffer []byte, thresholdValue *int64, simpleType string) []byte {
+	t := float64(defThreshold) / 255
+	if thresholdValue != nil {
+		t = float64(*thresholdValue) / 255
+	}
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		if _computeLuma(r, g, b) >= t {
+			return 1, 1, 1
 		}
+		return 0, 0, 0
+	})
+}
+
+func DuotoneImage(buffer []byte, shadowColor, highlightColor *color.RGBA, simpleType string) []byte {
+	shadow := color.RGBA{A: 255}
+	highlight := color.RGBA{A: 255, R: 255, G: 255, B: 255}
+	if shadowColor != nil {
+		shadow = *shadowColor
+	}
+	if highlightColor != nil {
+		highlight = *highlightColor
 	}
+	sR, sG, sB := float64(shadow.R)/255, float64(shadow.G)/255, float64(shadow.B)/255
+	hR, hG, hB := float64(highlight.R)/255, float64(highlight.G)/255, float64(highlight.B)/255
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		l := _computeLuma(r, g, b)
+		return sR + (hR-sR)*l, sG + (hG-sG)*l, sB + (hB-sB)*l
+	})
+}
 
-	return _saveImage(buffer, rgbImg, isPNG, isJPEG, isGIF, isBMP, isWebp)
+// _computeLuma Rec. 601 luma
+func _computeLuma(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
 }
 
-func ContrastImage(buffer []byte, contrastValue *int64, simpleType string) []byte {
-	if contrastValue == nil {
+func SaturationImage(buffer []byte, saturationValue *int64, simpleType string) []byte {
+	if saturationValue == nil || *saturationValue == 0 {
 		return buffer
 	}
+	scale := 1 + float64(*saturationValue)/100
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		l, c, h := _rgbToLch(r, g, b)
+		return _lchToRgb(l, c*scale, h)
+	})
+}
 
-	v := int32(*contrastValue)
-	if v == 0 {
+func HueImage(buffer []byte, hueValue *int64, simpleType string) []byte {
+	if hueValue == nil || *hueValue%360 == 0 {
+		return buffer
+	}
+	rotate := float64(*hueValue) * math.Pi / 180
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		l, c, h := _rgbToLch(r, g, b)
+		return _lchToRgb(l, c, h+rotate)
+	})
+}
+
+func GammaImage(buffer []byte, gammaValue *float64, simpleType string) []byte {
+	if gammaValue == nil || *gammaValue <= 0 || *gammaValue == 1 {
+		return buffer
+	}
+	// gamma above 1 lifts the mid tones
+	exponent := 1 / *gammaValue
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		return math.Pow(r, exponent), math.Pow(g, exponent), math.Pow(b, exponent)
+	})
+}
+
+func ExposureImage(buffer []byte, exposureValue *float64, simpleType string) []byte {
+	if exposureValue == nil || *exposureValue == 0 {
 		return buffer
 	}
+	// exposure is in stops, applied to linear light
+	scale := math.Pow(2, *exposureValue)
+	return _adjustImageBuffer(buffer, simpleType, func(r, g, b float64) (float64, float64, float64) {
+		return _linearToSrgb(_srgbToLinear(r) * scale), _linearToSrgb(_srgbToLinear(g) * scale), _linearToSrgb(_srgbToLinear(b) * scale)
+	})
+}
 
+func _adjustImageBuffer(buffer []byte, simpleType string, fn func(r, g, b float64) (float64, float64, float64)) []byte {
 	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
 
 	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
@@ -72,29 +155,28 @@ func ContrastImage(buffer []byte, contrastValue *int64, simpleType string) []byt
 		return buffer
 	}
 
-	t := defContrastThreshold
+	return _saveImage(buffer, _adjustImageColor(imgSrc, fn), isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
 
-	bounds := imgSrc.Bounds()
+// _adjustImageColor applies fn to the straight (not premultiplied) sRGB color of every pixel, values are in [0, 1] and alpha is kept
+func _adjustImageColor(imgSrc image.Image, fn func(r, g, b float64) (float64, float64, float64)) *image.NRGBA {
+	nrgbImg := _toNRGBA(imgSrc)
+	bounds := nrgbImg.Bounds()
 	sW := bounds.Dx()
 	sH := bounds.Dy()
 
-	rgbImg := image.NewRGBA(bounds)
-
 	for y := 0; y < sH; y++ {
 		for x := 0; x < sW; x++ {
-			r, g, b, a := imgSrc.At(x, y).RGBA()
-			rgbImg.SetRGBA(x, y, color.RGBA{
-				A: _fixColor(int32(a)),
-				R: _fixColor(_computeContrast(int32(r>>8), t, v)),
-				G: _fixColor(_computeContrast(int32(g>>8), t, v)),
-				B: _fixColor(_computeContrast(int32(b>>8), t, v)),
-			})
+			i := y*nrgbImg.Stride + x*4
+			p := nrgbImg.Pix[i : i+4 : i+4]
+			if p[3] == 0 {
+				continue
+			}
+			r, g, b := fn(float64(p[0])/255, float64(p[1])/255, float64(p[2])/255)
+			p[0] = _fixColor(int32(math.Round(r * 255)))
+			p[1] = _fixColor(int32(math.Round(g * 255)))
+			p[2] = _fixColor(int32(math.Round(b * 255)))
 		}
 	}
-
-	return _saveImage(buffer, rgbImg, isPNG, isJPEG, isGIF, isBMP, isWebp)
-}
-
-func _computeContrast(col int32, th int32, con int32) int32 {
-	return col + (col-th)*con/255
+	return nrgbImg
 }
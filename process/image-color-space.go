@@ -0,0 +1,96 @@
+package process
+
+import "math"
+
+// sRGB (D65) <-> CIE Lab conversion, all components of sRGB and linear values are in [0, 1]
+
+const (
+	labWhiteX = 0.95047
+	labWhiteY = 1.0
+	labWhiteZ = 1.08883
+)
+
+var srgbToLinearTable = func() [256]float64 {
+	var table [256]float64
+	for i := range table {
+		table[i] = __srgbToLinear(float64(i) / 255)
+	}
+	return table
+}()
+
+func _srgbToLinear(c float64) float64 {
+	if c >= 0 && c <= 1 && c*255 == math.Trunc(c*255) {
+		return srgbToLinearTable[int(c*255)]
+	}
+	return __srgbToLinear(c)
+}
+
+func __srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func _linearToSrgb(c float64) float64 {
+	if c <= 0 {
+		return 0
+	}
+	if c >= 1 {
+		return 1
+	}
+	if c <= 0.0031308 {
+		return c * 12.92
+	}
+	return 1.055*math.Pow(c, 1/2.4) - 0.055
+}
+
+func _rgbToLab(r, g, b float64) (float64, float64, float64) {
+	r = _srgbToLinear(r)
+	g = _srgbToLinear(g)
+	b = _srgbToLinear(b)
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / labWhiteX
+	y := (0.2126729*r + 0.7151522*g + 0.0721750*b) / labWhiteY
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / labWhiteZ
+	fX := _labF(x)
+	fY := _labF(y)
+	fZ := _labF(z)
+	return 116*fY - 16, 500 * (fX - fY), 200 * (fY - fZ)
+}
+
+func _labToRgb(l, a, b float64) (float64, float64, float64) {
+	fY := (l + 16) / 116
+	fX := fY + a/500
+	fZ := fY - b/200
+	x := _labFInverse(fX) * labWhiteX
+	y := _labFInverse(fY) * labWhiteY
+	z := _labFInverse(fZ) * labWhiteZ
+	r := 3.2404542*x - 1.5371385*y - 0.4985314*z
+	g := -0.9692660*x + 1.8760108*y + 0.0415560*z
+	bl := 0.0556434*x - 0.2040259*y + 1.0572252*z
+	return _linearToSrgb(r), _linearToSrgb(g), _linearToSrgb(bl)
+}
+
+// _rgbToLch returns lightness, chroma and hue (radian) of the Lab color
+func _rgbToLch(r, g, b float64) (float64, float64, float64) {
+	l, a, bb := _rgbToLab(r, g, b)
+	return l, math.Hypot(a, bb), math.Atan2(bb, a)
+}
+
+func _lchToRgb(l, c, h float64) (float64, float64, float64) {
+	return _labToRgb(l, c*math.Cos(h), c*math.Sin(h))
+}
+
+func _labF(t float64) float64 {
+	if t > 216.0/24389 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27*t + 16) / 116
+}
+
+func _labFInverse(t float64) float64 {
+	if t3 := t * t * t; t3 > 216.0/24389 {
+		return t3
+	}
+	return (116*t - 16) * 27 / 24389
+}
@@ -0,0 +1,249 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/chai2010/webp"
+	"github.com/nfnt/resize"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+)
+
+// CompressImageToSize encodes with the highest quality whose output fits in targetSize KB, the quality is searched
+// within the q range. When even the lowest quality is too large and downscale is set, the image is downscaled step by
+// step at the lowest quality, and the quality is searched again once it fits.
+func CompressImageToSize(buffer []byte, targetSize, qualityMin, qualityMax *int64, relative bool, sourceQuality int, downscale bool, simpleType string) []byte {
+	if targetSize == nil {
+		return buffer
+	}
+
+	isPNG, isJPEG, _, _, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isWebp) { // not support type
+		return buffer
+	}
+
+	limit := int(*targetSize) * 1024
+	if len(buffer) <= limit {
+		return buffer
+	}
+
+	min, max := _resolveQualityRange(sourceQuality, qualityMin, qualityMax, relative, defTargetSizeQualityMin, defTargetSizeQualityMax, isJPEG)
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	out := _searchSize(imgSrc, limit, min, max, downscale, _newQualityEncoder(imgSrc, isPNG, isJPEG, isWebp))
+	// nothing fits, the smallest attempt is the closest
+	if out == nil || len(out) >= len(buffer) {
+		return buffer
+	}
+	return out
+}
+
+// CompressImageToSsim encodes with the lowest quality in the q range whose SSIM against the decoded input reaches
+// targetSsim, and returns the achieved score. With targetSize the output also has to fit in targetSize KB, the size
+// wins when both can't be met. false when the input is kept, because it is already smaller or nothing could be encoded.
+func CompressImageToSsim(buffer []byte, targetSsim *float64, targetSize, qualityMin, qualityMax *int64, relative bool, sourceQuality int, downscale bool, simpleType string) ([]byte, float64, bool) {
+	if targetSsim == nil {
+		return buffer, 0, false
+	}
+
+	isPNG, isJPEG, _, _, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isWebp) { // not support type
+		return buffer, 0, false
+	}
+
+	min, max := _resolveQualityRange(sourceQuality, qualityMin, qualityMax, relative, defTargetSizeQualityMin, defTargetSizeQualityMax, isJPEG)
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer, 0, false
+	}
+
+	// both searches encode the source, each quality at most once
+	encode := _newQualityEncoder(imgSrc, isPNG, isJPEG, isWebp)
+
+	// search on the reversed scale, so the highest accepted value is the lowest quality
+	quality := 0
+	score := 0.0
+	out, ok := _searchQuality(min, max, func(reversed int) ([]byte, bool) {
+		q := min + max - reversed
+		buf := encode(imgSrc, q)
+		if buf == nil {
+			return nil, false
+		}
+		s, err := _computeBufferSsim(imgSrc, buf)
+		if err != nil {
+			fmt.Println(err)
+			return nil, false
+		}
+		if s >= *targetSsim {
+			quality, score = q, s
+			return buf, true
+		}
+		return buf, false
+	})
+	if !ok {
+		out, quality = nil, max+1
+	}
+
+	if targetSize != nil && (out == nil || len(out) > int(*targetSize)*1024) {
+		// the size limit wins, search below the quality that met the SSIM
+		limit := int(*targetSize) * 1024
+		if len(buffer) <= limit && out == nil {
+			return buffer, 0, false
+		}
+		out = _searchSize(imgSrc, limit, min, quality-1, downscale, encode)
+		if out != nil {
+			if score, err = _computeBufferSsim(imgSrc, out); err != nil {
+				score = 0
+			}
+		}
+	}
+	if out == nil || len(out) >= len(buffer) {
+		return buffer, 0, false
+	}
+	return out, score, true
+}
+
+func _computeBufferSsim(ref image.Image, buffer []byte) (float64, error) {
+	img, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		return 0, err
+	}
+	return _computeSsim(ref, img), nil
+}
+
+// _newQualityEncoder returns an encoder that remembers the outputs of imgSrc by quality, nil means encoding failed
+func _newQualityEncoder(imgSrc image.Image, isPNG, isJPEG, isWebp bool) func(img image.Image, quality int) []byte {
+	encoded := map[int][]byte{}
+	return func(img image.Image, quality int) []byte {
+		if img == imgSrc {
+			if buf, ok := encoded[quality]; ok {
+				return buf
+			}
+		}
+		buf, err := _encodeImageQuality(img, quality, isPNG, isJPEG, isWebp)
+		if err != nil {
+			fmt.Println(err)
+			buf = nil
+		}
+		if img == imgSrc {
+			encoded[quality] = buf
+		}
+		return buf
+	}
+}
+
+// _searchSize returns the output of the highest quality in [min, max] that fits in limit bytes. When none fits and
+// downscale is set, the image is downscaled at min until it fits. Otherwise the smallest output is returned.
+func _searchSize(imgSrc image.Image, limit, min, max int, downscale bool, encode func(img image.Image, quality int) []byte) []byte {
+	if max < min {
+		max = min
+	}
+	fitsAt := func(img image.Image) func(quality int) ([]byte, bool) {
+		return func(quality int) ([]byte, bool) {
+			buf := encode(img, quality)
+			return buf, buf != nil && len(buf) <= limit
+		}
+	}
+
+	smallest, fits := _searchQuality(min, max, fitsAt(imgSrc))
+	if fits {
+		return smallest
+	}
+
+	bounds := imgSrc.Bounds()
+	scale := 1.0
+	for downscale {
+		scale *= defTargetSizeScaleStep
+		w := math.Round(float64(bounds.Dx()) * scale)
+		h := math.Round(float64(bounds.Dy()) * scale)
+		if w < defTargetSizeMinSide || h < defTargetSizeMinSide {
+			break
+		}
+		img := resize.Resize(uint(w), uint(h), imgSrc, resize.Lanczos3)
+		out, fits := fitsAt(img)(min)
+		if fits {
+			// the lowest quality fits at this size, a higher one may too
+			if min < max {
+				if better, ok := _searchQuality(min+1, max, fitsAt(img)); ok {
+					return better
+				}
+			}
+			return out
+		}
+		if out != nil && (smallest == nil || len(out) < len(smallest)) {
+			smallest = out
+		}
+	}
+	return smallest
+}
+
+// _searchQuality binary searches the highest quality in [min, max] that encode accepts, assuming larger qualities
+// give larger outputs. Without any accepted quality the output of min is returned with false.
+func _searchQuality(min, max int, encode func(quality int) ([]byte, bool)) ([]byte, bool) {
+	var best []byte
+	var lowest []byte
+	lo, hi := min, max
+	for lo <= hi {
+		mid := lo + (hi-lo)/2
+		out, ok := encode(mid)
+		if ok {
+			best = out
+			lo = mid + 1
+		} else {
+			if mid == min {
+				lowest = out
+			}
+			hi = mid - 1
+		}
+	}
+	if best != nil {
+		return best, true
+	}
+	if lowest == nil {
+		lowest, _ = encode(min)
+	}
+	return lowest, false
+}
+
+// _encodeImageQuality encodes with a lossy quality in [1, 100], for png the quality drives the palette quantization
+func _encodeImageQuality(img image.Image, quality int, isPNG, isJPEG, isWebp bool) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	writer := bufio.NewWriter(buf)
+	var err error
+	switch {
+	case isJPEG:
+		err = jpeg.Encode(writer, img, &jpeg.Options{Quality: quality})
+		break
+	case isWebp:
+		err = webp.Encode(writer, img, &webp.Options{Quality: float32(quality)})
+		break
+	case isPNG:
+		bounds := img.Bounds()
+		cmpImg := _compressPng(img, bounds.Dx(), bounds.Dy(), 0, quality)
+		if cmpImg == nil {
+			return nil, errors.New("png quantization failed")
+		}
+		err = png.Encode(writer, cmpImg)
+		break
+	default:
+		return nil, errors.New("not support type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = writer.Flush()
+	return buf.Bytes(), nil
+}
@@ -12,33 +12,59 @@ import (
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"math"
 )
 
-func CompressImage(buffer []byte, qualityMin, qualityMax *int64, simpleType string) []byte {
+// CompressImage recompresses within the quality range, sourceQuality is the estimated JPEG quality of the original
+// object that a relative range scales by, 0 when unknown
+func CompressImage(buffer []byte, qualityMin, qualityMax *int64, relative bool, sourceQuality int, simpleType string) []byte {
 	isPNG, isJPEG, _, isGIF, _ := checkImageType(simpleType)
 
 	if !(isPNG || isJPEG || isGIF) { // not support type
 		return buffer
 	}
 
-	min := defCompressMin
-	max := defCompressMax
-	if qualityMin != nil {
-		min = int(*qualityMin)
-	}
-	if qualityMax != nil {
-		max = int(*qualityMax)
+	min, max := _resolveQualityRange(sourceQuality, qualityMin, qualityMax, relative, defCompressMin, defCompressMax, isJPEG)
+	if (isPNG || isGIF) && qualityMin != nil && *qualityMin == *qualityMax {
+		// a single value is the target, the quantizer may go as low as it needs to reach it
+		min = 0
 	}
 
+	var cmpBuffer []byte
 	if isPNG {
-		buffer = compressPng(buffer, min, max)
+		cmpBuffer = compressPng(buffer, min, max)
 	} else if isJPEG {
-		buffer = compressJpeg(buffer, min, max)
+		cmpBuffer = compressJpeg(buffer, min, max)
 	} else if isGIF {
-		buffer = compressGif(buffer, min, max)
+		cmpBuffer = compressGif(buffer, min, max)
+	}
+
+	// recompressing never makes the image larger
+	if len(cmpBuffer) >= len(buffer) {
+		return buffer
 	}
+	return cmpBuffer
+}
 
-	return buffer
+// _resolveQualityRange turns the q or Q range into encoder qualities. A relative range on a JPEG is scaled by and
+// capped at the source quality, an absolute one is kept. Other formats have no source quality to relate to.
+func _resolveQualityRange(sourceQuality int, qualityMin, qualityMax *int64, relative bool, defMin, defMax int, isJPEG bool) (int, int) {
+	min := defMin
+	max := defMax
+	if qualityMin != nil {
+		min = int(*qualityMin)
+	}
+	if qualityMax != nil {
+		max = int(*qualityMax)
+	}
+	if !isJPEG || !relative || sourceQuality <= 0 {
+		return min, max
+	}
+	min = int(math.Max(1, math.Round(float64(sourceQuality*min)/100)))
+	max = int(math.Max(1, math.Round(float64(sourceQuality*max)/100)))
+	min = int(math.Min(float64(min), float64(sourceQuality)))
+	max = int(math.Min(float64(max), float64(sourceQuality)))
+	return min, max
 }
 
 func compressJpeg(buffer []byte, min, max int) []byte {
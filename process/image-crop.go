@@ -9,14 +9,13 @@ import (
 	"image/color"
 	"image/draw"
 	_ "image/gif"
-	"image/jpeg"
 	_ "image/jpeg"
 	"image/png"
 	_ "image/png"
 	"math"
 )
 
-func CropImage(buffer []byte, cropWidth, cropHeight, cropX, cropY *int64, simpleType string) []byte {
+func CropImage(buffer []byte, cropWidth, cropHeight, cropX, cropY *int64, cropGravity *ImageGravity, simpleType string) []byte {
 	if cropWidth == nil && cropHeight == nil {
 		return buffer
 	}
@@ -60,6 +59,23 @@ func CropImage(buffer []byte, cropWidth, cropHeight, cropX, cropY *int64, simple
 		return buffer
 	}
 
+	if cropGravity != nil {
+		bounds := imgSrc.Bounds()
+		if w == 0 {
+			w = bounds.Dx()
+		}
+		if h == 0 {
+			h = bounds.Dy()
+		}
+		if *cropGravity == autoGravity {
+			w = int(math.Min(float64(w), float64(bounds.Dx())))
+			h = int(math.Min(float64(h), float64(bounds.Dy())))
+			x, y = _computeSmartCropPosition(imgSrc, w, h)
+		} else {
+			x, y = _computeGravityPosition(bounds.Dx(), bounds.Dy(), w, h, x, y, *cropGravity)
+		}
+	}
+
 	cropImg := _cropImage(imgSrc, w, h, x, y)
 
 	if cropImg == nil {
@@ -70,25 +86,30 @@ func CropImage(buffer []byte, cropWidth, cropHeight, cropX, cropY *int64, simple
 }
 
 func _cropImage(imgSrc image.Image, w int, h int, x int, y int) image.Image {
-	var cropImg image.Image
-	if rgbImg, ok := imgSrc.(*image.YCbCr); ok {
-		cropImg = rgbImg.SubImage(image.Rect(x, y, x+w, y+h)).(*image.YCbCr) //图片裁剪x0 y0 x1 y1
-	} else if rgbImg, ok := imgSrc.(*image.RGBA); ok {
-		cropImg = rgbImg.SubImage(image.Rect(x, y, x+w, y+h)).(*image.RGBA) //图片裁剪x0 y0 x1 y1
-	} else if rgbImg, ok := imgSrc.(*image.NRGBA); ok {
-		cropImg = rgbImg.SubImage(image.Rect(x, y, x+w, y+h)).(*image.NRGBA) //图片裁剪x0 y0 x1 y1
+	bounds := imgSrc.Bounds()
+	rect := image.Rect(x, y, x+w, y+h).Add(bounds.Min) //图片裁剪x0 y0 x1 y1
+	if subImg, ok := imgSrc.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return subImg.SubImage(rect)
 	}
+	rect = rect.Intersect(bounds)
+	cropImg := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropImg, cropImg.Bounds(), imgSrc, rect.Min, draw.Src)
 	return cropImg
 }
 
-func CircleCropImage(buffer []byte, cropRadius *int64, formatType *ImageFormatType, simpleType string) (bufferT []byte, resultType string) {
+func CircleCropImage(buffer []byte, cropRadius *int64, ellipse bool, background *color.RGBA, formatType *ImageFormatType, simpleType string) (bufferT []byte, resultType string) {
 	resultType = simpleType
 	bufferT = buffer
-	if cropRadius == nil {
+	if cropRadius == nil && !ellipse {
 		return
 	}
-	radius := int(math.Max(0, float64(*cropRadius)))
-	if radius == 0 {
+	radius := 0
+	if cropRadius != nil {
+		radius = int(math.Max(0, float64(*cropRadius)))
+	}
+	if radius == 0 && !ellipse {
 		return
 	}
 
@@ -107,6 +128,14 @@ func CircleCropImage(buffer []byte, cropRadius *int64, formatType *ImageFormatTy
 	width := bounds.Dx()
 	height := bounds.Dy()
 
+	if ellipse { // the ellipse inscribed in the whole image
+		render := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.DrawMask(render, render.Bounds(), imgSrc, bounds.Min, &roundedCorner{
+			Width: width, Height: height, Ellipse: true,
+		}, image.Point{}, draw.Over)
+		return _saveAlphaImage(buffer, render, background, formatType, simpleType)
+	}
+
 	// fixed radius
 	radius = int(math.Min(float64(radius), math.Min(float64(width), float64(height))*0.5))
 
@@ -130,49 +159,29 @@ func CircleCropImage(buffer []byte, cropRadius *int64, formatType *ImageFormatTy
 		return
 	}
 
-	isFormatJpeg := formatType == nil || *formatType != pngType
-
-	render := image.NewRGBA(image.Rect(0, 0, w, w))
-	if isFormatJpeg {
-		draw.Draw(render, render.Bounds(), &image.Uniform{
-			C: color.RGBA{
-				A: 255,
-				R: 255,
-				G: 255,
-				B: 255,
-			},
-		}, image.Point{}, draw.Src)
-	}
+	render := image.NewNRGBA(image.Rect(0, 0, w, w))
 	draw.DrawMask(render, cropImg.Bounds(), cropImg, image.Point{}, &roundedCorner{
-		Width: w, Height: w, Radius: radius,
+		Width: w, Height: w, TopLeft: radius, TopRight: radius, BottomRight: radius, BottomLeft: radius,
 	}, image.Point{}, draw.Over)
 
-	buf = bytes.NewBuffer(nil)
-	writer = bufio.NewWriter(buf)
-	if isFormatJpeg {
-		err = jpeg.Encode(writer, render, nil)
-		resultType = "jpeg"
-	} else {
-		err = png.Encode(writer, render)
-		resultType = "png"
-	}
-	if err != nil {
-		fmt.Println(err)
-		return buffer, simpleType
-	}
-	_ = writer.Flush()
-
-	return buf.Bytes(), resultType
+	return _saveAlphaImage(buffer, render, background, formatType, simpleType)
 }
 
-func RoundedCornerCropImage(buffer []byte, cropRadius *int64, formatType *ImageFormatType, simpleType string) (bufferT []byte, resultType string) {
+func RoundedCornerCropImage(buffer []byte, cropRadius, topLeft, topRight, bottomRight, bottomLeft *int64, background *color.RGBA, formatType *ImageFormatType, simpleType string) (bufferT []byte, resultType string) {
 	resultType = simpleType
 	bufferT = buffer
-	if cropRadius == nil {
-		return
+
+	// a corner without its own radius uses r
+	radii := [4]int{}
+	for i, cornerRadius := range [4]*int64{topLeft, topRight, bottomRight, bottomLeft} {
+		if cornerRadius == nil {
+			cornerRadius = cropRadius
+		}
+		if cornerRadius != nil {
+			radii[i] = int(math.Max(0, float64(*cornerRadius)))
+		}
 	}
-	radius := int(math.Max(0, float64(*cropRadius)))
-	if radius == 0 {
+	if radii == [4]int{} {
 		return
 	}
 
@@ -192,39 +201,58 @@ func RoundedCornerCropImage(buffer []byte, cropRadius *int64, formatType *ImageF
 	height := bounds.Dy()
 
 	// fixed radius
-	radius = int(math.Min(float64(radius), math.Min(float64(width), float64(height))*0.5))
+	for i := range radii {
+		radii[i] = int(math.Min(float64(radii[i]), math.Min(float64(width), float64(height))*0.5))
+	}
 
-	isFormatJpeg := formatType == nil || *formatType != pngType
-
-	render := image.NewRGBA(bounds)
-	if isFormatJpeg {
-		draw.Draw(render, render.Bounds(), &image.Uniform{
-			C: color.RGBA{
-				A: 255,
-				R: 255,
-				G: 255,
-				B: 255,
-			},
-		}, image.Point{}, draw.Src)
-	}
-	draw.DrawMask(render, imgSrc.Bounds(), imgSrc, image.Point{}, &roundedCorner{
-		Width: width, Height: height, Radius: radius,
+	render := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.DrawMask(render, render.Bounds(), imgSrc, bounds.Min, &roundedCorner{
+		Width: width, Height: height, TopLeft: radii[0], TopRight: radii[1], BottomRight: radii[2], BottomLeft: radii[3],
 	}, image.Point{}, draw.Over)
 
-	buf := bytes.NewBuffer(nil)
-	writer := bufio.NewWriter(buf)
-	if isFormatJpeg {
-		err = jpeg.Encode(writer, render, nil)
-		resultType = "jpeg"
-	} else {
-		err = png.Encode(writer, render)
+	return _saveAlphaImage(buffer, render, background, formatType, simpleType)
+}
+
+// _saveAlphaImage encodes an image with transparent areas for the format the pipeline ends with, formatType when a
+// format action is given, else the current one. Png, webp and gif keep the transparency, jpeg and bmp are flattened
+// on the background, white by default.
+func _saveAlphaImage(buffer []byte, img image.Image, background *color.RGBA, formatType *ImageFormatType, simpleType string) (bufferT []byte, resultType string) {
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+	resultType = simpleType
+
+	keepAlpha := isPNG || isGIF || isWebp
+	if formatType != nil {
+		keepAlpha = *formatType == pngType || *formatType == gifType || *formatType == webpType
+	}
+
+	if keepAlpha && !(isPNG || isGIF || isWebp) {
+		// the current format can't hold transparency, use png until the format action converts it
+		isPNG, isJPEG, isBMP = true, false, false
 		resultType = "png"
 	}
+
+	if !keepAlpha {
+		bg := color.RGBA{
+			A: 255,
+			R: 255,
+			G: 255,
+			B: 255,
+		}
+		if background != nil {
+			bg = *background
+			bg.A = 255
+		}
+		bounds := img.Bounds()
+		render := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(render, render.Bounds(), &image.Uniform{C: bg}, image.Point{}, draw.Src)
+		draw.Draw(render, render.Bounds(), img, bounds.Min, draw.Over)
+		img = render
+	}
+
+	buf, err := _encodeAlphaImage(img, isPNG, isJPEG, isGIF, isBMP, isWebp)
 	if err != nil {
 		fmt.Println(err)
 		return buffer, simpleType
 	}
-	_ = writer.Flush()
-
-	return buf.Bytes(), resultType
+	return buf, resultType
 }
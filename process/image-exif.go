@@ -0,0 +1,240 @@
+package process
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	exifIFDPointerTag = 0x8769
+	exifGPSPointerTag = 0x8825
+)
+
+var exifTagNames = map[uint16]string{
+	// IFD0
+	0x010E: "ImageDescription",
+	0x010F: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011A: "XResolution",
+	0x011B: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x0213: "YCbCrPositioning",
+	0x8298: "Copyright",
+	// Exif IFD
+	0x829A: "ExposureTime",
+	0x829D: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920A: "FocalLength",
+	0xA001: "ColorSpace",
+	0xA002: "PixelXDimension",
+	0xA003: "PixelYDimension",
+	0xA402: "ExposureMode",
+	0xA403: "WhiteBalance",
+	0xA405: "FocalLengthIn35mmFilm",
+	0xA434: "LensModel",
+}
+
+var exifGPSTagNames = map[uint16]string{
+	0x0001: "GPSLatitudeRef",
+	0x0002: "GPSLatitude",
+	0x0003: "GPSLongitudeRef",
+	0x0004: "GPSLongitude",
+	0x0005: "GPSAltitudeRef",
+	0x0006: "GPSAltitude",
+}
+
+// exifTypeSize byte size of each tiff field type
+var exifTypeSize = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8,
+}
+
+// _readExif returns the known exif tags of a jpeg, png or webp image, nil if there is none
+func _readExif(buffer []byte) map[string]string {
+	tiff := _findExifTiff(buffer)
+	if tiff == nil || len(tiff) < 8 {
+		return nil
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+		break
+	case "MM":
+		order = binary.BigEndian
+		break
+	default:
+		return nil
+	}
+
+	tags := make(map[string]string)
+	ifd0 := order.Uint32(tiff[4:8])
+	pointers := _readExifIFD(tiff, order, ifd0, exifTagNames, tags)
+	if offset, ok := pointers[exifIFDPointerTag]; ok {
+		_readExifIFD(tiff, order, offset, exifTagNames, tags)
+	}
+	if offset, ok := pointers[exifGPSPointerTag]; ok {
+		_readExifIFD(tiff, order, offset, exifGPSTagNames, tags)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// _findExifTiff locates the tiff structure holding the exif data
+func _findExifTiff(buffer []byte) []byte {
+	switch {
+	case len(buffer) > 4 && buffer[0] == 0xFF && buffer[1] == 0xD8: // jpeg APP1
+		for i := 2; i+4 <= len(buffer); {
+			if buffer[i] != 0xFF {
+				return nil
+			}
+			marker := buffer[i+1]
+			if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 || marker == 0xFF {
+				i++
+				continue
+			}
+			if marker == 0xDA || marker == 0xD9 { // image data begins
+				return nil
+			}
+			length := int(binary.BigEndian.Uint16(buffer[i+2 : i+4]))
+			end := i + 2 + length
+			if length < 2 || end > len(buffer) {
+				return nil
+			}
+			segment := buffer[i+4 : end]
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment[6:]
+			}
+			i = end
+		}
+		break
+	case len(buffer) > 8 && bytes.HasPrefix(buffer, []byte("\x89PNG\r\n\x1a\n")): // png eXIf chunk
+		for i := 8; i+8 <= len(buffer); {
+			length := int(binary.BigEndian.Uint32(buffer[i : i+4]))
+			end := i + 12 + length
+			if length < 0 || end > len(buffer) {
+				return nil
+			}
+			if string(buffer[i+4:i+8]) == "eXIf" {
+				return buffer[i+8 : i+8+length]
+			}
+			i = end
+		}
+		break
+	case len(buffer) > 12 && string(buffer[0:4]) == "RIFF" && string(buffer[8:12]) == "WEBP": // webp EXIF chunk
+		for i := 12; i+8 <= len(buffer); {
+			length := int(binary.LittleEndian.Uint32(buffer[i+4 : i+8]))
+			end := i + 8 + length + length%2
+			if length < 0 || i+8+length > len(buffer) {
+				return nil
+			}
+			if string(buffer[i:i+4]) == "EXIF" {
+				data := buffer[i+8 : i+8+length]
+				if bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+					data = data[6:]
+				}
+				return data
+			}
+			i = end
+		}
+		break
+	}
+	return nil
+}
+
+// _readExifIFD reads the entries of one IFD into tags, and returns the offsets of the sub IFDs it points to
+func _readExifIFD(tiff []byte, order binary.ByteOrder, offset uint32, names map[uint16]string, tags map[string]string) map[uint16]uint32 {
+	pointers := make(map[uint16]uint32)
+	start := int(offset)
+	if start <= 0 || start+2 > len(tiff) {
+		return pointers
+	}
+	count := int(order.Uint16(tiff[start : start+2]))
+	for i := 0; i < count; i++ {
+		entry := start + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry : entry+2])
+		fieldType := order.Uint16(tiff[entry+2 : entry+4])
+		n := int(order.Uint32(tiff[entry+4 : entry+8]))
+		size, ok := exifTypeSize[fieldType]
+		if !ok || n <= 0 || n > len(tiff) {
+			continue
+		}
+		data := tiff[entry+8 : entry+12]
+		if size*n > 4 {
+			valueOffset := int(order.Uint32(data))
+			if valueOffset < 0 || valueOffset+size*n > len(tiff) {
+				continue
+			}
+			data = tiff[valueOffset : valueOffset+size*n]
+		}
+		if tag == exifIFDPointerTag || tag == exifGPSPointerTag {
+			pointers[tag] = order.Uint32(data)
+			continue
+		}
+		if name, ok := names[tag]; ok {
+			tags[name] = _formatExifValue(data, order, fieldType, n)
+		}
+	}
+	return pointers
+}
+
+func _formatExifValue(data []byte, order binary.ByteOrder, fieldType uint16, n int) string {
+	if fieldType == 2 { // ascii
+		return strings.TrimSpace(strings.TrimRight(string(data[:n]), "\x00"))
+	}
+	if fieldType == 7 { // undefined
+		return strings.TrimSpace(strings.TrimRight(string(data[:n]), "\x00"))
+	}
+	values := make([]string, 0, n)
+	size := exifTypeSize[fieldType]
+	for i := 0; i < n; i++ {
+		v := data[i*size : (i+1)*size]
+		switch fieldType {
+		case 1: // byte
+			values = append(values, strconv.Itoa(int(v[0])))
+			break
+		case 6: // signed byte
+			values = append(values, strconv.Itoa(int(int8(v[0]))))
+			break
+		case 3: // short
+			values = append(values, strconv.Itoa(int(order.Uint16(v))))
+			break
+		case 8: // signed short
+			values = append(values, strconv.Itoa(int(int16(order.Uint16(v)))))
+			break
+		case 4: // long
+			values = append(values, strconv.FormatUint(uint64(order.Uint32(v)), 10))
+			break
+		case 9: // signed long
+			values = append(values, strconv.Itoa(int(int32(order.Uint32(v)))))
+			break
+		case 5: // rational
+			values = append(values, fmt.Sprintf("%d/%d", order.Uint32(v[0:4]), order.Uint32(v[4:8])))
+			break
+		case 10: // signed rational
+			values = append(values, fmt.Sprintf("%d/%d", int32(order.Uint32(v[0:4])), int32(order.Uint32(v[4:8]))))
+			break
+		}
+	}
+	return strings.Join(values, ", ")
+}
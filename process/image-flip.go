@@ -0,0 +1,154 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+func FlipImage(buffer []byte, flipMode *ImageFlipMode, simpleType string) []byte {
+	if flipMode == nil {
+		return buffer
+	}
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	flipImg := _flipImage(imgSrc, *flipMode)
+
+	return _saveImage(buffer, flipImg, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+func TransposeImage(buffer []byte, simpleType string) []byte {
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	bounds := imgSrc.Bounds()
+	transposeImg := _transformImage(imgSrc, bounds.Dy(), bounds.Dx(), func(x, y int) (int, int) {
+		return y, x
+	})
+
+	return _saveImage(buffer, transposeImg, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+func _flipImage(imgSrc image.Image, flipMode ImageFlipMode) image.Image {
+	bounds := imgSrc.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+	return _transformImage(imgSrc, w, h, func(x, y int) (int, int) {
+		if flipMode == flipHorizontal || flipMode == flipBoth {
+			x = w - 1 - x
+		}
+		if flipMode == flipVertical || flipMode == flipBoth {
+			y = h - 1 - y
+		}
+		return x, y
+	})
+}
+
+// _transformImage builds a w*h image of the same kind as imgSrc, copying each pixel (x, y) from the source pixel returned by srcPoint.
+// Pixels are copied untouched, so flips, transposes and right angle rotations are lossless.
+func _transformImage(imgSrc image.Image, w, h int, srcPoint func(x, y int) (int, int)) image.Image {
+	bounds := imgSrc.Bounds()
+	rect := image.Rect(0, 0, w, h)
+
+	var dst image.Image
+	var srcPix, dstPix []byte
+	var srcStride, dstStride, bpp int
+	switch src := imgSrc.(type) {
+	case *image.RGBA:
+		img := image.NewRGBA(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 4
+		break
+	case *image.NRGBA:
+		img := image.NewNRGBA(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 4
+		break
+	case *image.RGBA64:
+		img := image.NewRGBA64(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 8
+		break
+	case *image.NRGBA64:
+		img := image.NewNRGBA64(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 8
+		break
+	case *image.Gray:
+		img := image.NewGray(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 1
+		break
+	case *image.Gray16:
+		img := image.NewGray16(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 2
+		break
+	case *image.Alpha:
+		img := image.NewAlpha(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 1
+		break
+	case *image.Alpha16:
+		img := image.NewAlpha16(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 2
+		break
+	case *image.CMYK:
+		img := image.NewCMYK(rect)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 4
+		break
+	case *image.Paletted:
+		img := image.NewPaletted(rect, src.Palette)
+		dst, srcPix, srcStride, dstPix, dstStride, bpp = img, src.Pix, src.Stride, img.Pix, img.Stride, 1
+		break
+	case *image.YCbCr: // chroma is expanded to 4:4:4 so every pixel keeps its own samples
+		img := image.NewYCbCr(rect, image.YCbCrSubsampleRatio444)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sX, sY := srcPoint(x, y)
+				sX += bounds.Min.X
+				sY += bounds.Min.Y
+				yi := src.YOffset(sX, sY)
+				ci := src.COffset(sX, sY)
+				i := y*img.YStride + x
+				img.Y[i] = src.Y[yi]
+				img.Cb[i] = src.Cb[ci]
+				img.Cr[i] = src.Cr[ci]
+			}
+		}
+		return img
+	default:
+		img := image.NewRGBA64(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sX, sY := srcPoint(x, y)
+				img.Set(x, y, imgSrc.At(sX+bounds.Min.X, sY+bounds.Min.Y))
+			}
+		}
+		return img
+	}
+
+	for y := 0; y < h; y++ {
+		d := y * dstStride
+		for x := 0; x < w; x++ {
+			sX, sY := srcPoint(x, y)
+			s := sY*srcStride + sX*bpp
+			copy(dstPix[d:d+bpp], srcPix[s:s+bpp])
+			d += bpp
+		}
+	}
+	return dst
+}
@@ -8,9 +8,10 @@ import (
 	"golang.org/x/image/bmp"
 	_ "golang.org/x/image/webp"
 	"image"
-	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"strconv"
+	"strings"
 )
 
 func FormatImage(buffer []byte, formatType *ImageFormatType, simpleType string) (bufferT []byte, resultType string) {
@@ -45,7 +46,7 @@ func FormatImage(buffer []byte, formatType *ImageFormatType, simpleType string)
 		resultType = "jpeg"
 		break
 	case gifType:
-		err = gif.Encode(writer, imgSrc, nil)
+		err = _encodeGif(writer, imgSrc)
 		resultType = "gif"
 		break
 	case bmpType:
@@ -65,3 +66,152 @@ func FormatImage(buffer []byte, formatType *ImageFormatType, simpleType string)
 
 	return buf.Bytes(), resultType
 }
+
+// AutoFormatImage picks webp when the Accept header allows it, otherwise png for images with transparency and jpeg
+// for opaque ones. An image already in the picked format is kept as it is.
+func AutoFormatImage(buffer []byte, accept string, simpleType string) (bufferT []byte, resultType string) {
+	resultType = simpleType
+	bufferT = buffer
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	opaque := true
+	if opaqueImg, ok := imgSrc.(interface{ Opaque() bool }); ok {
+		opaque = opaqueImg.Opaque()
+	}
+
+	switch {
+	case _acceptsMediaType(accept, "image/webp"):
+		if isWebp {
+			return
+		}
+		resultType = "webp"
+		break
+	case !opaque:
+		if isPNG {
+			return
+		}
+		resultType = "png"
+		break
+	default:
+		if isJPEG {
+			return
+		}
+		resultType = "jpeg"
+		break
+	}
+
+	var buf []byte
+	if resultType == "png" { // lossless, quantizing is up to the quality action
+		buf = _saveImage(nil, imgSrc, true, false, false, false, false)
+	} else {
+		buf, err = _encodeImageQuality(imgSrc, defAutoFormatQuality, false, resultType == "jpeg", resultType == "webp")
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	if len(buf) == 0 {
+		return buffer, simpleType
+	}
+	return buf, resultType
+}
+
+// _acceptsMediaType reports whether the Accept header lists the media type with a non-zero q, wildcards are not
+// taken as support since browsers send */* for formats they can't show
+func _acceptsMediaType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), mediaType) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil && q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// SmallestFormatImage encodes jpeg, lossy webp and quantized png candidates concurrently and keeps the smallest whose
+// SSIM against the input reaches ssim. The input itself competes too, so the output is never larger. webp only
+// competes when the Accept header of the client lists it.
+func SmallestFormatImage(buffer []byte, quality *int64, ssim *float64, accept string, simpleType string) (bufferT []byte, resultType string) {
+	resultType = simpleType
+	bufferT = buffer
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return
+	}
+
+	q := defSmallestFormatQuality
+	threshold := defSmallestFormatSsim
+	if quality != nil {
+		q = int(*quality)
+	}
+	if ssim != nil {
+		threshold = *ssim
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	types := []string{"png"}
+	if _acceptsMediaType(accept, "image/webp") {
+		types = append(types, "webp")
+	}
+	if opaqueImg, ok := imgSrc.(interface{ Opaque() bool }); ok && opaqueImg.Opaque() {
+		types = append(types, "jpeg") // jpeg would drop the transparency
+	}
+
+	ch := make(chan goFormatCandidate)
+	for i := range types {
+		go _encodeFormatCandidate(ch, imgSrc, types[i], q)
+	}
+	for range types {
+		candidate := <-ch
+		if candidate.Result == nil || candidate.Ssim < threshold {
+			continue
+		}
+		if len(candidate.Result) < len(bufferT) {
+			bufferT = candidate.Result
+			resultType = candidate.Type
+		}
+	}
+	return
+}
+
+func _encodeFormatCandidate(ch chan goFormatCandidate, imgSrc image.Image, resultType string, quality int) {
+	candidate := goFormatCandidate{
+		Type: resultType,
+	}
+	buf, err := _encodeImageQuality(imgSrc, quality, resultType == "png", resultType == "jpeg", resultType == "webp")
+	if err == nil {
+		candidate.Ssim, err = _computeBufferSsim(imgSrc, buf)
+	}
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		candidate.Result = buf
+	}
+	ch <- candidate
+}
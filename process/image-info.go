@@ -0,0 +1,53 @@
+package process
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strconv"
+)
+
+// imageInfoValue
+type imageInfoValue struct {
+	Value string `json:"value"`
+}
+
+// ImageInfo returns the info as JSON, false when the image can't be read and the buffer is returned as it is
+func ImageInfo(buffer []byte, simpleType string) ([]byte, bool) {
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer, false
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer, false
+	}
+	if format == "jpeg" {
+		format = "jpg"
+	}
+
+	info := map[string]imageInfoValue{
+		"FileSize":    {Value: strconv.Itoa(len(buffer))},
+		"Format":      {Value: format},
+		"ImageWidth":  {Value: strconv.Itoa(config.Width)},
+		"ImageHeight": {Value: strconv.Itoa(config.Height)},
+	}
+	for name, value := range _readExif(buffer) {
+		info[name] = imageInfoValue{Value: value}
+	}
+
+	result, err := json.Marshal(info)
+	if err != nil {
+		fmt.Println(err)
+		return buffer, false
+	}
+	return result, true
+}
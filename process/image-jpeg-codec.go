@@ -0,0 +1,914 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// jpegZigzag maps the zigzag position of a coefficient to its natural (row major) position in the 8x8 block
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+const jpegHuffmanLookupBits = 9
+
+// jpegCoefficients
+// -----------
+// Quantized DCT coefficients of a sequential Huffman JPEG, enough to write it back or to decode it at a reduced
+// size without going through pixels first
+type jpegCoefficients struct {
+	Width      int
+	Height     int
+	Components []*jpegComponent
+	// quantization tables in natural order, nil when not defined
+	Quant          [4]*[64]uint16
+	QuantPrecision [4]uint8
+	// APPn and COM segments with their markers, copied as they are
+	Segments [][]byte
+	// MCUs between the restart markers of the written scan, 0 writes none
+	RestartInterval int
+	// 2, 4 or 8 decodes every block straight to 8/Scale pixels in the component Plane instead of keeping Blocks
+	Scale int
+	idct  [8][8]float64
+}
+
+// jpegComponent
+// -----------
+// One color component, Blocks covers whole MCUs so it can be larger than the image. Coefficients of 8-bit samples
+// fit in 16 bits, as in libjpeg.
+type jpegComponent struct {
+	ID      uint8
+	H       int
+	V       int
+	Tq      uint8
+	BlocksW int
+	BlocksH int
+	Blocks  [][64]int16
+	Plane   []byte
+}
+
+type jpegHuffmanDecoder struct {
+	lookup  [1 << jpegHuffmanLookupBits]uint16 // code length << 8 | value, 0 when the code is longer
+	maxCode [17]int32
+	valPtr  [17]int32
+	minCode [17]int32
+	values  []byte
+}
+
+type jpegBitReader struct {
+	data   []byte
+	pos    int
+	acc    uint32
+	n      int
+	marker bool // a marker was reached, zeros are fed from here
+}
+
+// mcuSize returns the MCU size in pixels
+func (c *jpegCoefficients) mcuSize() (int, int) {
+	hMax, vMax := 1, 1
+	for _, comp := range c.Components {
+		if comp.H > hMax {
+			hMax = comp.H
+		}
+		if comp.V > vMax {
+			vMax = comp.V
+		}
+	}
+	return 8 * hMax, 8 * vMax
+}
+
+// mcuCount returns the number of MCUs across and down
+func (c *jpegCoefficients) mcuCount() (int, int) {
+	mcuW, mcuH := c.mcuSize()
+	return (c.Width + mcuW - 1) / mcuW, (c.Height + mcuH - 1) / mcuH
+}
+
+// componentBlocks returns the blocks of the component that hold image pixels, the rest only pads MCUs
+func (c *jpegCoefficients) componentBlocks(comp *jpegComponent) (int, int) {
+	mcuW, mcuH := c.mcuSize()
+	w := (c.Width*comp.H*8 + mcuW - 1) / mcuW
+	h := (c.Height*comp.V*8 + mcuH - 1) / mcuH
+	return (w + 7) / 8, (h + 7) / 8
+}
+
+// _readJpegCoefficients entropy decodes a baseline or extended sequential Huffman JPEG
+func _readJpegCoefficients(buffer []byte) (*jpegCoefficients, error) {
+	return _readJpeg(buffer, 1)
+}
+
+func _readJpeg(buffer []byte, scale int) (*jpegCoefficients, error) {
+	if len(buffer) < 4 || buffer[0] != 0xFF || buffer[1] != 0xD8 {
+		return nil, errors.New("jpeg: missing SOI marker")
+	}
+
+	c := &jpegCoefficients{Scale: scale}
+	var huffman [2][4]*jpegHuffmanDecoder
+	restartInterval := 0
+	frame := false
+	scanned := false
+
+	pos := 2
+	for {
+		if pos+2 > len(buffer) {
+			return nil, errors.New("jpeg: unexpected end of data")
+		}
+		if buffer[pos] != 0xFF {
+			return nil, fmt.Errorf("jpeg: expected marker at %d", pos)
+		}
+		marker := buffer[pos+1]
+		if marker == 0xFF { // fill byte
+			pos += 1
+			continue
+		}
+		if marker == 0xD9 { // end of image
+			break
+		}
+		if pos+4 > len(buffer) {
+			return nil, errors.New("jpeg: unexpected end of data")
+		}
+		length := int(binary.BigEndian.Uint16(buffer[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(buffer) {
+			return nil, errors.New("jpeg: invalid segment length")
+		}
+		segment := buffer[pos+4 : end]
+
+		switch {
+		case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE: // APPn, COM
+			c.Segments = append(c.Segments, buffer[pos:end])
+			break
+		case marker == 0xDB: // DQT
+			if err := _readJpegQuant(c, segment); err != nil {
+				return nil, err
+			}
+			break
+		case marker == 0xC4: // DHT
+			if err := _readJpegHuffman(&huffman, segment); err != nil {
+				return nil, err
+			}
+			break
+		case marker == 0xDD: // DRI
+			if len(segment) < 2 {
+				return nil, errors.New("jpeg: invalid DRI")
+			}
+			restartInterval = int(binary.BigEndian.Uint16(segment))
+			break
+		case marker == 0xC0 || marker == 0xC1: // SOF0, SOF1
+			if frame {
+				return nil, errors.New("jpeg: multiple frames")
+			}
+			if err := _readJpegFrame(c, segment); err != nil {
+				return nil, err
+			}
+			frame = true
+			break
+		case marker >= 0xC2 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			return nil, errors.New("jpeg: only sequential Huffman coding is supported")
+		case marker == 0xDA: // SOS
+			if !frame {
+				return nil, errors.New("jpeg: scan before frame")
+			}
+			next, err := _readJpegScan(c, &huffman, restartInterval, segment, buffer, end)
+			if err != nil {
+				return nil, err
+			}
+			scanned = true
+			pos = next
+			continue
+		}
+		pos = end
+	}
+
+	if !scanned {
+		return nil, errors.New("jpeg: no image data")
+	}
+	for _, comp := range c.Components {
+		if c.Quant[comp.Tq] == nil {
+			return nil, errors.New("jpeg: missing quantization table")
+		}
+	}
+	return c, nil
+}
+
+func _readJpegQuant(c *jpegCoefficients, segment []byte) error {
+	for p := 0; p < len(segment); {
+		precision := segment[p] >> 4
+		id := segment[p] & 0x0F
+		size := 64
+		if precision != 0 {
+			size = 128
+		}
+		if id > 3 || precision > 1 || p+1+size > len(segment) {
+			return errors.New("jpeg: invalid DQT")
+		}
+		table := &[64]uint16{}
+		for k := 0; k < 64; k++ {
+			if precision != 0 {
+				table[jpegZigzag[k]] = binary.BigEndian.Uint16(segment[p+1+k*2:])
+			} else {
+				table[jpegZigzag[k]] = uint16(segment[p+1+k])
+			}
+		}
+		c.Quant[id] = table
+		c.QuantPrecision[id] = precision
+		p += 1 + size
+	}
+	return nil
+}
+
+func _readJpegHuffman(huffman *[2][4]*jpegHuffmanDecoder, segment []byte) error {
+	for p := 0; p < len(segment); {
+		if p+17 > len(segment) {
+			return errors.New("jpeg: invalid DHT")
+		}
+		class := segment[p] >> 4
+		id := segment[p] & 0x0F
+		if class > 1 || id > 3 {
+			return errors.New("jpeg: invalid DHT")
+		}
+		var counts [16]byte
+		copy(counts[:], segment[p+1:p+17])
+		total := 0
+		for _, n := range counts {
+			total += int(n)
+		}
+		if total > 256 || p+17+total > len(segment) {
+			return errors.New("jpeg: invalid DHT")
+		}
+		decoder, err := _newJpegHuffmanDecoder(counts, segment[p+17:p+17+total])
+		if err != nil {
+			return err
+		}
+		huffman[class][id] = decoder
+		p += 17 + total
+	}
+	return nil
+}
+
+func _newJpegHuffmanDecoder(counts [16]byte, values []byte) (*jpegHuffmanDecoder, error) {
+	h := &jpegHuffmanDecoder{
+		values: append([]byte{}, values...),
+	}
+	code := int32(0)
+	k := int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		if code+n > 1<<uint(l) { // more codes than the length can hold
+			return nil, errors.New("jpeg: invalid Huffman table")
+		}
+		h.valPtr[l] = k
+		h.minCode[l] = code
+		h.maxCode[l] = -1
+		if n > 0 {
+			h.maxCode[l] = code + n - 1
+		}
+		if l <= jpegHuffmanLookupBits {
+			for i := int32(0); i < n; i++ {
+				shift := uint(jpegHuffmanLookupBits - l)
+				first := (code + i) << shift
+				for j := int32(0); j < 1<<shift; j++ {
+					h.lookup[first+j] = uint16(l)<<8 | uint16(values[k+i])
+				}
+			}
+		}
+		code += n
+		k += n
+		code <<= 1
+	}
+	return h, nil
+}
+
+func _readJpegFrame(c *jpegCoefficients, segment []byte) error {
+	if len(segment) < 6 {
+		return errors.New("jpeg: invalid SOF")
+	}
+	if segment[0] != 8 {
+		return errors.New("jpeg: only 8-bit samples are supported")
+	}
+	c.Height = int(binary.BigEndian.Uint16(segment[1:3]))
+	c.Width = int(binary.BigEndian.Uint16(segment[3:5]))
+	n := int(segment[5])
+	if c.Width == 0 || c.Height == 0 || (n != 1 && n != 3) || len(segment) < 6+n*3 {
+		return errors.New("jpeg: unsupported frame")
+	}
+	// the blocks are allocated from the header alone, before any image data backs them
+	if c.Width*c.Height > defJpegMaxPixels {
+		return errors.New("jpeg: image is too large")
+	}
+	for i := 0; i < n; i++ {
+		p := segment[6+i*3:]
+		comp := &jpegComponent{
+			ID: p[0],
+			H:  int(p[1] >> 4),
+			V:  int(p[1] & 0x0F),
+			Tq: p[2],
+		}
+		if comp.H < 1 || comp.H > 4 || comp.V < 1 || comp.V > 4 || comp.Tq > 3 {
+			return errors.New("jpeg: invalid component")
+		}
+		c.Components = append(c.Components, comp)
+	}
+	mcusX, mcusY := c.mcuCount()
+	for _, comp := range c.Components {
+		comp.BlocksW = mcusX * comp.H
+		comp.BlocksH = mcusY * comp.V
+		if c.Scale > 1 {
+			size := 8 / c.Scale
+			comp.Plane = make([]byte, comp.BlocksW*size*comp.BlocksH*size)
+		} else {
+			comp.Blocks = make([][64]int16, comp.BlocksW*comp.BlocksH)
+		}
+	}
+	return nil
+}
+
+// _readJpegScan decodes the entropy coded data following the SOS segment that ends at start, and returns the
+// position of the marker after it
+func _readJpegScan(c *jpegCoefficients, huffman *[2][4]*jpegHuffmanDecoder, restartInterval int, segment, buffer []byte, start int) (int, error) {
+	if len(segment) < 1 {
+		return 0, errors.New("jpeg: invalid SOS")
+	}
+	n := int(segment[0])
+	if n < 1 || n > len(c.Components) || len(segment) < 1+n*2+3 {
+		return 0, errors.New("jpeg: invalid SOS")
+	}
+	if segment[1+n*2] != 0 || segment[2+n*2] != 63 || segment[3+n*2] != 0 {
+		return 0, errors.New("jpeg: unsupported scan")
+	}
+
+	comps := make([]*jpegComponent, n)
+	dc := make([]*jpegHuffmanDecoder, n)
+	ac := make([]*jpegHuffmanDecoder, n)
+	for i := 0; i < n; i++ {
+		id := segment[1+i*2]
+		for _, comp := range c.Components {
+			if comp.ID == id {
+				comps[i] = comp
+			}
+		}
+		dc[i] = huffman[0][(segment[2+i*2]>>4)&3]
+		ac[i] = huffman[1][segment[2+i*2]&3]
+		if comps[i] == nil || dc[i] == nil || ac[i] == nil {
+			return 0, errors.New("jpeg: invalid SOS")
+		}
+	}
+
+	reader := &jpegBitReader{data: buffer, pos: start}
+	pred := make([]int32, n)
+	var scratch [64]int16
+	decode := func(i int, bx, by int) error {
+		comp := comps[i]
+		if bx >= comp.BlocksW || by >= comp.BlocksH {
+			return errors.New("jpeg: block out of range")
+		}
+		block := &scratch
+		if c.Scale > 1 {
+			scratch = [64]int16{}
+		} else {
+			block = &comp.Blocks[by*comp.BlocksW+bx]
+		}
+		s, err := reader.decodeHuffman(dc[i])
+		if err != nil {
+			return err
+		}
+		pred[i] += reader.receiveExtend(int(s))
+		if pred[i] < math.MinInt16 || pred[i] > math.MaxInt16 {
+			return errors.New("jpeg: invalid DC coefficient")
+		}
+		block[0] = int16(pred[i])
+		for k := 1; k < 64; k++ {
+			rs, err := reader.decodeHuffman(ac[i])
+			if err != nil {
+				return err
+			}
+			r := int(rs >> 4)
+			s := int(rs & 0x0F)
+			if s == 0 {
+				if r != 15 { // end of block
+					break
+				}
+				k += 15
+				continue
+			}
+			k += r
+			if k > 63 {
+				return errors.New("jpeg: invalid AC coefficient")
+			}
+			block[jpegZigzag[k]] = int16(reader.receiveExtend(s))
+		}
+		if c.Scale > 1 {
+			return c.reduceBlock(comp, bx, by, block)
+		}
+		return nil
+	}
+
+	var units [][3]int // component, block x, block y of every block in coding order
+	if n == 1 {
+		bW, bH := c.componentBlocks(comps[0])
+		for by := 0; by < bH; by++ {
+			for bx := 0; bx < bW; bx++ {
+				units = append(units, [3]int{0, bx, by})
+			}
+		}
+	} else {
+		mcusX, mcusY := c.mcuCount()
+		units = make([][3]int, 0, mcusX*mcusY)
+		for my := 0; my < mcusY; my++ {
+			for mx := 0; mx < mcusX; mx++ {
+				units = append(units, [3]int{-1, mx, my})
+			}
+		}
+	}
+
+	for u, unit := range units {
+		if restartInterval > 0 && u > 0 && u%restartInterval == 0 {
+			if err := reader.restart(); err != nil {
+				return 0, err
+			}
+			for i := range pred {
+				pred[i] = 0
+			}
+		}
+		if unit[0] >= 0 {
+			if err := decode(unit[0], unit[1], unit[2]); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		for i, comp := range comps {
+			for v := 0; v < comp.V; v++ {
+				for h := 0; h < comp.H; h++ {
+					if err := decode(i, unit[1]*comp.H+h, unit[2]*comp.V+v); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+	}
+
+	return reader.nextMarker(), nil
+}
+
+func (r *jpegBitReader) fill() {
+	for r.n <= 24 {
+		var b byte
+		if !r.marker && r.pos < len(r.data) {
+			b = r.data[r.pos]
+			if b == 0xFF {
+				if r.pos+1 < len(r.data) && r.data[r.pos+1] == 0x00 { // stuffed byte
+					r.pos += 2
+				} else {
+					r.marker = true
+					b = 0
+				}
+			} else {
+				r.pos += 1
+			}
+		}
+		r.acc |= uint32(b) << uint(24-r.n)
+		r.n += 8
+	}
+}
+
+func (r *jpegBitReader) peek(n int) uint32 {
+	if r.n < n {
+		r.fill()
+	}
+	return r.acc >> uint(32-n)
+}
+
+func (r *jpegBitReader) skip(n int) {
+	r.acc <<= uint(n)
+	r.n -= n
+}
+
+func (r *jpegBitReader) receiveExtend(s int) int32 {
+	if s == 0 {
+		return 0
+	}
+	v := int32(r.peek(s))
+	r.skip(s)
+	if v < 1<<uint(s-1) {
+		v -= 1<<uint(s) - 1
+	}
+	return v
+}
+
+func (r *jpegBitReader) decodeHuffman(h *jpegHuffmanDecoder) (byte, error) {
+	if e := h.lookup[r.peek(jpegHuffmanLookupBits)]; e != 0 {
+		r.skip(int(e >> 8))
+		return byte(e), nil
+	}
+	code := int32(r.peek(16))
+	for l := jpegHuffmanLookupBits + 1; l <= 16; l++ {
+		c := code >> uint(16-l)
+		if c <= h.maxCode[l] {
+			r.skip(l)
+			return h.values[h.valPtr[l]+c-h.minCode[l]], nil
+		}
+	}
+	return 0, errors.New("jpeg: invalid Huffman code")
+}
+
+// restart drops the padding bits of the interval and steps over the RSTn marker
+func (r *jpegBitReader) restart() error {
+	r.acc = 0
+	r.n = 0
+	r.marker = false
+	for r.pos+1 < len(r.data) && !(r.data[r.pos] == 0xFF && r.data[r.pos+1] != 0x00 && r.data[r.pos+1] != 0xFF) {
+		r.pos += 1
+	}
+	if r.pos+1 >= len(r.data) || r.data[r.pos+1] < 0xD0 || r.data[r.pos+1] > 0xD7 {
+		return errors.New("jpeg: missing restart marker")
+	}
+	r.pos += 2
+	return nil
+}
+
+// nextMarker returns the position of the first marker that is not a restart marker
+func (r *jpegBitReader) nextMarker() int {
+	p := r.pos
+	for p+1 < len(r.data) {
+		if r.data[p] == 0xFF && r.data[p+1] != 0x00 && r.data[p+1] != 0xFF && (r.data[p+1] < 0xD0 || r.data[p+1] > 0xD7) {
+			return p
+		}
+		p += 1
+	}
+	return len(r.data)
+}
+
+type jpegHuffmanEncoder struct {
+	code [256]uint16
+	size [256]uint8
+}
+
+type jpegBitWriter struct {
+	writer *bufio.Writer
+	acc    uint32
+	n      int
+}
+
+func (w *jpegBitWriter) emit(code uint32, size int) {
+	if size == 0 {
+		return
+	}
+	w.acc |= (code & (1<<uint(size) - 1)) << uint(32-w.n-size)
+	w.n += size
+	for w.n >= 8 {
+		b := byte(w.acc >> 24)
+		_ = w.writer.WriteByte(b)
+		if b == 0xFF {
+			_ = w.writer.WriteByte(0x00)
+		}
+		w.acc <<= 8
+		w.n -= 8
+	}
+}
+
+func (w *jpegBitWriter) flush() {
+	if w.n > 0 {
+		w.emit(1<<uint(8-w.n)-1, 8-w.n)
+	}
+}
+
+// _writeJpegCoefficients encodes the coefficients as a baseline JPEG with optimized Huffman tables
+func _writeJpegCoefficients(c *jpegCoefficients) ([]byte, error) {
+	n := len(c.Components)
+	if n == 0 || c.Width < 1 || c.Height < 1 || c.Width > 65535 || c.Height > 65535 {
+		return nil, errors.New("jpeg: nothing to encode")
+	}
+	if c.RestartInterval < 0 || c.RestartInterval > 65535 {
+		return nil, errors.New("jpeg: invalid restart interval")
+	}
+	table := func(i int) int { // luminance and chrominance tables
+		if i == 0 {
+			return 0
+		}
+		return 1
+	}
+
+	// the first pass counts symbols, the second writes them with the tables built from the counts
+	var dcFreq, acFreq [2][256]int
+	var dcEnc, acEnc [2]*jpegHuffmanEncoder
+	var bits *jpegBitWriter
+	pred := make([]int32, n)
+	encodeBlock := func(i int, block *[64]int16) {
+		t := table(i)
+		diff := int32(block[0]) - pred[i]
+		pred[i] = int32(block[0])
+		s, v := _jpegMagnitude(diff)
+		if bits == nil {
+			dcFreq[t][s] += 1
+		} else {
+			bits.emit(uint32(dcEnc[t].code[s]), int(dcEnc[t].size[s]))
+			bits.emit(v, s)
+		}
+		r := 0
+		for k := 1; k < 64; k++ {
+			coef := block[jpegZigzag[k]]
+			if coef == 0 {
+				r += 1
+				continue
+			}
+			for r > 15 {
+				if bits == nil {
+					acFreq[t][0xF0] += 1
+				} else {
+					bits.emit(uint32(acEnc[t].code[0xF0]), int(acEnc[t].size[0xF0]))
+				}
+				r -= 16
+			}
+			s, v := _jpegMagnitude(int32(coef))
+			symbol := r<<4 | s
+			if bits == nil {
+				acFreq[t][symbol] += 1
+			} else {
+				bits.emit(uint32(acEnc[t].code[symbol]), int(acEnc[t].size[symbol]))
+				bits.emit(v, s)
+			}
+			r = 0
+		}
+		if r > 0 { // end of block
+			if bits == nil {
+				acFreq[t][0x00] += 1
+			} else {
+				bits.emit(uint32(acEnc[t].code[0x00]), int(acEnc[t].size[0x00]))
+			}
+		}
+	}
+	walk := func() {
+		for i := range pred {
+			pred[i] = 0
+		}
+		unit := 0
+		// every interval ends byte aligned with an RSTn marker and starts over with zero DC predictions
+		restart := func() {
+			if c.RestartInterval > 0 && unit > 0 && unit%c.RestartInterval == 0 {
+				if bits != nil {
+					bits.flush()
+					_, _ = bits.writer.Write([]byte{0xFF, byte(0xD0 + (unit/c.RestartInterval-1)%8)})
+				}
+				for i := range pred {
+					pred[i] = 0
+				}
+			}
+			unit += 1
+		}
+		if n == 1 {
+			comp := c.Components[0]
+			bW, bH := c.componentBlocks(comp)
+			for by := 0; by < bH; by++ {
+				for bx := 0; bx < bW; bx++ {
+					restart()
+					encodeBlock(0, &comp.Blocks[by*comp.BlocksW+bx])
+				}
+			}
+			return
+		}
+		mcusX, mcusY := c.mcuCount()
+		for my := 0; my < mcusY; my++ {
+			for mx := 0; mx < mcusX; mx++ {
+				restart()
+				for i, comp := range c.Components {
+					for v := 0; v < comp.V; v++ {
+						for h := 0; h < comp.H; h++ {
+							encodeBlock(i, &comp.Blocks[(my*comp.V+v)*comp.BlocksW+mx*comp.H+h])
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for _, comp := range c.Components {
+		mcusX, mcusY := c.mcuCount()
+		if comp.BlocksW < mcusX*comp.H || comp.BlocksH < mcusY*comp.V || c.Quant[comp.Tq] == nil {
+			return nil, errors.New("jpeg: inconsistent components")
+		}
+	}
+
+	walk()
+
+	buf := bytes.NewBuffer(nil)
+	writer := bufio.NewWriter(buf)
+	_, _ = writer.Write([]byte{0xFF, 0xD8})
+	for _, segment := range c.Segments {
+		_, _ = writer.Write(segment)
+	}
+
+	// DQT
+	extended := false
+	for id, quant := range c.Quant {
+		if quant == nil {
+			continue
+		}
+		used := false
+		for _, comp := range c.Components {
+			used = used || int(comp.Tq) == id
+		}
+		if !used {
+			continue
+		}
+		precision := c.QuantPrecision[id]
+		size := 64
+		if precision != 0 {
+			size = 128
+			extended = true
+		}
+		_, _ = writer.Write([]byte{0xFF, 0xDB, byte((size + 3) >> 8), byte(size + 3), precision<<4 | byte(id)})
+		for k := 0; k < 64; k++ {
+			q := quant[jpegZigzag[k]]
+			if precision != 0 {
+				_, _ = writer.Write([]byte{byte(q >> 8), byte(q)})
+			} else {
+				_ = writer.WriteByte(byte(q))
+			}
+		}
+	}
+
+	// SOF0, or SOF1 for 16-bit quantization tables
+	sof := byte(0xC0)
+	if extended {
+		sof = 0xC1
+	}
+	length := 8 + n*3
+	_, _ = writer.Write([]byte{0xFF, sof, byte(length >> 8), byte(length), 8,
+		byte(c.Height >> 8), byte(c.Height), byte(c.Width >> 8), byte(c.Width), byte(n)})
+	for _, comp := range c.Components {
+		_, _ = writer.Write([]byte{comp.ID, byte(comp.H<<4 | comp.V), comp.Tq})
+	}
+
+	// DHT
+	tables := 1
+	if n > 1 {
+		tables = 2
+	}
+	for t := 0; t < tables; t++ {
+		for class, freq := range [2]*[256]int{&dcFreq[t], &acFreq[t]} {
+			counts, values := _buildJpegHuffman(*freq)
+			encoder := _newJpegHuffmanEncoder(counts, values)
+			if class == 0 {
+				dcEnc[t] = encoder
+			} else {
+				acEnc[t] = encoder
+			}
+			length := 2 + 17 + len(values)
+			_, _ = writer.Write([]byte{0xFF, 0xC4, byte(length >> 8), byte(length), byte(class<<4 | t)})
+			_, _ = writer.Write(counts[:])
+			_, _ = writer.Write(values)
+		}
+	}
+
+	// DRI
+	if c.RestartInterval > 0 {
+		_, _ = writer.Write([]byte{0xFF, 0xDD, 0, 4, byte(c.RestartInterval >> 8), byte(c.RestartInterval)})
+	}
+
+	// SOS
+	length = 6 + n*2
+	_, _ = writer.Write([]byte{0xFF, 0xDA, byte(length >> 8), byte(length), byte(n)})
+	for i, comp := range c.Components {
+		t := byte(table(i))
+		_, _ = writer.Write([]byte{comp.ID, t<<4 | t})
+	}
+	_, _ = writer.Write([]byte{0, 63, 0})
+
+	bits = &jpegBitWriter{writer: writer}
+	walk()
+	bits.flush()
+
+	_, _ = writer.Write([]byte{0xFF, 0xD9})
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// _jpegMagnitude returns the size category of v and its additional bits
+func _jpegMagnitude(v int32) (int, uint32) {
+	a := v
+	if a < 0 {
+		a = -a
+		v -= 1
+	}
+	s := 0
+	for a > 0 {
+		s += 1
+		a >>= 1
+	}
+	return s, uint32(v) & (1<<uint(s) - 1)
+}
+
+// _buildJpegHuffman builds code lengths limited to 16 bits from symbol counts, as in Annex K.2 of the JPEG spec
+func _buildJpegHuffman(freq [256]int) ([16]byte, []byte) {
+	var f [257]int
+	copy(f[:], freq[:])
+	used := false
+	for _, v := range freq {
+		used = used || v > 0
+	}
+	if !used {
+		f[0] = 1
+	}
+	f[256] = 1 // reserved so that no code is all ones
+
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		c1, c2 := -1, -1
+		for i := range f { // the least frequent, the largest symbol on ties
+			if f[i] > 0 && (c1 < 0 || f[i] <= f[c1]) {
+				c1 = i
+			}
+		}
+		for i := range f {
+			if f[i] > 0 && i != c1 && (c2 < 0 || f[i] <= f[c2]) {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		f[c1] += f[c2]
+		f[c2] = 0
+		codeSize[c1] += 1
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1] += 1
+		}
+		others[c1] = c2
+		codeSize[c2] += 1
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2] += 1
+		}
+	}
+
+	var bits [33]int
+	for _, size := range codeSize {
+		if size > 0 {
+			bits[size] += 1
+		}
+	}
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j -= 1
+			}
+			bits[i] -= 2
+			bits[i-1] += 1
+			bits[j+1] += 2
+			bits[j] -= 1
+		}
+	}
+	i := 16
+	for bits[i] == 0 {
+		i -= 1
+	}
+	bits[i] -= 1 // drop the reserved symbol
+
+	var counts [16]byte
+	for l := 1; l <= 16; l++ {
+		counts[l-1] = byte(bits[l])
+	}
+	var values []byte
+	for size := 1; size <= 32; size++ {
+		for symbol := 0; symbol < 256; symbol++ {
+			if codeSize[symbol] == size {
+				values = append(values, byte(symbol))
+			}
+		}
+	}
+	return counts, values
+}
+
+func _newJpegHuffmanEncoder(counts [16]byte, values []byte) *jpegHuffmanEncoder {
+	e := &jpegHuffmanEncoder{}
+	code := uint16(0)
+	k := 0
+	for l := 1; l <= 16; l++ {
+		for i := 0; i < int(counts[l-1]); i++ {
+			e.code[values[k]] = code
+			e.size[values[k]] = uint8(l)
+			code += 1
+			k += 1
+		}
+		code <<= 1
+	}
+	return e
+}
@@ -0,0 +1,243 @@
+package process
+
+import (
+	"fmt"
+	"image"
+	"regexp"
+)
+
+// _losslessJpegTransform runs a pipeline made only of right angle rotations, flips, transposes and crops on the DCT
+// coefficients of a JPEG, like jpegtran does, so the image is not re-encoded. false means the normal path has to
+// run: another action is present, the JPEG is not sequential Huffman coded, or a step would need partial MCUs. A
+// pipeline that leaves the image as it is is also false, the normal path returns the buffer untouched.
+func _losslessJpegTransform(actions []ObjectProcess, buffer []byte, simpleType string) ([]byte, bool) {
+	if len(actions) == 0 || !regexp.MustCompile(`(?i)jpeg`).MatchString(simpleType) {
+		return nil, false
+	}
+	for _, action := range actions {
+		switch action.Action {
+		case ImageRotateAction:
+			if action.ImageValue != nil && *action.ImageValue%90 != 0 {
+				return nil, false
+			}
+			break
+		case ImageCropAction:
+			if action.ImageGravity != nil && *action.ImageGravity == autoGravity {
+				return nil, false
+			}
+			break
+		case ImageFlipAction, ImageTransposeAction:
+			break
+		default:
+			return nil, false
+		}
+	}
+
+	c, err := _readJpegCoefficients(buffer)
+	if err != nil {
+		fmt.Println(err)
+		return nil, false
+	}
+
+	changed := false
+	for _, action := range actions {
+		ok := true
+		switch action.Action {
+		case ImageRotateAction:
+			if action.ImageValue == nil {
+				break
+			}
+			switch (*action.ImageValue%360 + 360) % 360 {
+			case 90:
+				c.transpose()
+				ok = c.flip(true, false)
+				changed = true
+				break
+			case 180:
+				ok = c.flip(true, true)
+				changed = true
+				break
+			case 270:
+				c.transpose()
+				ok = c.flip(false, true)
+				changed = true
+				break
+			}
+			break
+		case ImageFlipAction:
+			if action.ImageFlipMode == nil {
+				break
+			}
+			ok = c.flip(*action.ImageFlipMode != flipVertical, *action.ImageFlipMode != flipHorizontal)
+			changed = true
+			break
+		case ImageTransposeAction:
+			c.transpose()
+			changed = true
+			break
+		case ImageCropAction:
+			// a crop keeps the origin only when it keeps the whole image
+			w, h := c.Width, c.Height
+			ok = _losslessJpegCrop(c, action)
+			changed = changed || c.Width != w || c.Height != h
+			break
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	if !changed {
+		return nil, false
+	}
+
+	c.dropMetadata()
+
+	buf, err := _writeJpegCoefficients(c)
+	if err != nil {
+		fmt.Println(err)
+		return nil, false
+	}
+	return buf, true
+}
+
+// _losslessJpegCrop applies the crop action the way CropImage computes it, the crop origin has to be on an MCU
+func _losslessJpegCrop(c *jpegCoefficients, action ObjectProcess) bool {
+	if action.ImageWidth == nil && action.ImageHeight == nil {
+		return true
+	}
+	w, h, x, y := 0, 0, 0, 0
+	if action.ImageWidth != nil && *action.ImageWidth > 0 {
+		w = int(*action.ImageWidth)
+	}
+	if action.ImageHeight != nil && *action.ImageHeight > 0 {
+		h = int(*action.ImageHeight)
+	}
+	if w == 0 && h == 0 {
+		return true
+	}
+	if action.ImagePositionX != nil {
+		x = int(*action.ImagePositionX)
+	}
+	if action.ImagePositionY != nil {
+		y = int(*action.ImagePositionY)
+	}
+	if action.ImageGravity != nil {
+		if w == 0 {
+			w = c.Width
+		}
+		if h == 0 {
+			h = c.Height
+		}
+		x, y = _computeGravityPosition(c.Width, c.Height, w, h, x, y, *action.ImageGravity)
+	}
+
+	rect := image.Rect(x, y, x+w, y+h).Intersect(image.Rect(0, 0, c.Width, c.Height))
+	if rect.Empty() {
+		return false
+	}
+	return c.crop(rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy())
+}
+
+// dropMetadata removes the APP1 segments, EXIF and XMP, like the decode and encode path does. Their orientation,
+// dimensions and thumbnail describe the image before the transform, viewers would apply a stale orientation.
+func (c *jpegCoefficients) dropMetadata() {
+	segments := c.Segments[:0]
+	for _, segment := range c.Segments {
+		if segment[1] != 0xE1 {
+			segments = append(segments, segment)
+		}
+	}
+	c.Segments = segments
+}
+
+// transpose mirrors the image along its main diagonal, quantization tables and sampling factors are swapped along
+func (c *jpegCoefficients) transpose() {
+	for _, comp := range c.Components {
+		blocks := make([][64]int16, len(comp.Blocks))
+		for by := 0; by < comp.BlocksH; by++ {
+			for bx := 0; bx < comp.BlocksW; bx++ {
+				src := &comp.Blocks[by*comp.BlocksW+bx]
+				dst := &blocks[bx*comp.BlocksH+by]
+				for v := 0; v < 8; v++ {
+					for u := 0; u < 8; u++ {
+						dst[u*8+v] = src[v*8+u]
+					}
+				}
+			}
+		}
+		comp.Blocks = blocks
+		comp.BlocksW, comp.BlocksH = comp.BlocksH, comp.BlocksW
+		comp.H, comp.V = comp.V, comp.H
+	}
+	for _, quant := range c.Quant {
+		if quant == nil {
+			continue
+		}
+		for v := 0; v < 8; v++ {
+			for u := v + 1; u < 8; u++ {
+				quant[v*8+u], quant[u*8+v] = quant[u*8+v], quant[v*8+u]
+			}
+		}
+	}
+	c.Width, c.Height = c.Height, c.Width
+}
+
+// flip mirrors the image, false when the mirrored side ends in a partial MCU that can't move to the other side
+func (c *jpegCoefficients) flip(horizontal, vertical bool) bool {
+	mcuW, mcuH := c.mcuSize()
+	if (horizontal && c.Width%mcuW != 0) || (vertical && c.Height%mcuH != 0) {
+		return false
+	}
+	for _, comp := range c.Components {
+		blocks := make([][64]int16, len(comp.Blocks))
+		for by := 0; by < comp.BlocksH; by++ {
+			for bx := 0; bx < comp.BlocksW; bx++ {
+				tX, tY := bx, by
+				if horizontal {
+					tX = comp.BlocksW - 1 - bx
+				}
+				if vertical {
+					tY = comp.BlocksH - 1 - by
+				}
+				// mirroring a block negates the coefficients of odd frequencies in that direction
+				dst := &blocks[tY*comp.BlocksW+tX]
+				*dst = comp.Blocks[by*comp.BlocksW+bx]
+				for v := 0; v < 8; v++ {
+					for u := 0; u < 8; u++ {
+						if (horizontal && u%2 == 1) != (vertical && v%2 == 1) {
+							dst[v*8+u] = -dst[v*8+u]
+						}
+					}
+				}
+			}
+		}
+		comp.Blocks = blocks
+	}
+	return true
+}
+
+// crop keeps the w*h area at (x, y), false when (x, y) is not on an MCU corner
+func (c *jpegCoefficients) crop(x, y, w, h int) bool {
+	mcuW, mcuH := c.mcuSize()
+	if x%mcuW != 0 || y%mcuH != 0 {
+		return false
+	}
+	mcusX := (w + mcuW - 1) / mcuW
+	mcusY := (h + mcuH - 1) / mcuH
+	for _, comp := range c.Components {
+		oX := x / mcuW * comp.H
+		oY := y / mcuH * comp.V
+		bW := mcusX * comp.H
+		bH := mcusY * comp.V
+		blocks := make([][64]int16, bW*bH)
+		for by := 0; by < bH; by++ {
+			copy(blocks[by*bW:(by+1)*bW], comp.Blocks[(oY+by)*comp.BlocksW+oX:])
+		}
+		comp.Blocks = blocks
+		comp.BlocksW = bW
+		comp.BlocksH = bH
+	}
+	c.Width = w
+	c.Height = h
+	return true
+}
@@ -0,0 +1,238 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var losslessJpegQueries = []string{
+	"image/rotate,90",
+	"image/rotate,180",
+	"image/rotate,270",
+	"image/flip,h",
+	"image/flip,v",
+	"image/flip,hv",
+	"image/transpose",
+	"image/crop,x_16,y_16,w_32,h_16",
+	"image/crop,w_32,h_16,g_se",
+	"image/rotate,90/flip,h/crop,w_16,h_16",
+}
+
+func TestLosslessJpegTransform(t *testing.T) {
+	for _, size := range [][2]int{{64, 48}, {70, 48}, {64, 50}, {70, 50}, {17, 9}} {
+		src := _testJpeg(t, _testImage(size[0], size[1], false))
+		for _, query := range losslessJpegQueries {
+			name := fmt.Sprintf("%dx%d %s", size[0], size[1], query)
+			ok := _checkLosslessJpegTransform(t, name, src, query)
+			// on whole MCUs nothing falls back, the other sizes fall back for some of the queries
+			if size == [2]int{64, 48} && !ok {
+				t.Errorf("%s: fell back on an MCU aligned image", name)
+			}
+		}
+	}
+}
+
+func TestLosslessJpegTransformGray(t *testing.T) {
+	src := _testJpeg(t, _testImage(64, 48, true))
+	for _, query := range losslessJpegQueries {
+		name := fmt.Sprintf("gray %s", query)
+		if !_checkLosslessJpegTransform(t, name, src, query) {
+			t.Errorf("%s: fell back on an MCU aligned image", name)
+		}
+	}
+}
+
+func TestLosslessJpegNoop(t *testing.T) {
+	src := _testJpeg(t, _testImage(64, 48, false))
+	for _, query := range []string{"image/rotate", "image/rotate,0", "image/rotate,360", "image/flip", "image/crop", "image/crop,w_64,h_48", "image/rotate,0/flip"} {
+		info := parseObjectProcessInfo(query)
+		if _, ok := _losslessJpegTransform(info.Actions, src, "jpeg"); ok {
+			t.Errorf("%s: re-encoded an unchanged image", query)
+		}
+	}
+}
+
+func TestLosslessJpegRestartInterval(t *testing.T) {
+	src := _testJpeg(t, _testImage(70, 50, false))
+	c, err := _readJpegCoefficients(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, interval := range []int{1, 3, 7} {
+		c.RestartInterval = interval
+		buf, err := _writeJpegCoefficients(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the standard decoder reads the markers the same way
+		want, err := jpeg.Decode(bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := jpeg.Decode(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("interval %d: %v", interval, err)
+		}
+		if diff := _testMaxDiff(want, got); diff != 0 {
+			t.Errorf("interval %d: written image differs by %d", interval, diff)
+		}
+
+		// and so does ours
+		read, err := _readJpegCoefficients(buf)
+		if err != nil {
+			t.Fatalf("interval %d: %v", interval, err)
+		}
+		for i, comp := range read.Components {
+			for k := range comp.Blocks {
+				if comp.Blocks[k] != c.Components[i].Blocks[k] {
+					t.Fatalf("interval %d: component %d block %d differs", interval, i, k)
+				}
+			}
+		}
+		_checkLosslessJpegTransform(t, fmt.Sprintf("interval %d", interval), buf, "image/transpose")
+	}
+}
+
+func TestLosslessJpegProgressiveFallback(t *testing.T) {
+	src := _testJpeg(t, _testImage(64, 48, false))
+	progressive := append([]byte{}, src...)
+	for i := 2; i+1 < len(progressive); i++ {
+		if progressive[i] == 0xFF && progressive[i+1] == 0xC0 {
+			progressive[i+1] = 0xC2 // SOF2
+			break
+		}
+	}
+	if !_isSequentialJpeg(src) || _isSequentialJpeg(progressive) {
+		t.Error("frame marker misread")
+	}
+	if _, err := _readJpegCoefficients(progressive); err == nil {
+		t.Error("progressive JPEG was read")
+	}
+	info := parseObjectProcessInfo("image/rotate,90")
+	if _, ok := _losslessJpegTransform(info.Actions, progressive, "jpeg"); ok {
+		t.Error("progressive JPEG was transformed losslessly")
+	}
+}
+
+func TestLosslessJpegCorruptInput(t *testing.T) {
+	src := _testJpeg(t, _testImage(70, 50, false))
+	info := parseObjectProcessInfo("image/rotate,180")
+	inputs := [][]byte{nil, {0xFF, 0xD8}}
+	for n := 0; n < len(src); n += 7 {
+		inputs = append(inputs, src[:n])
+	}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		corrupt := append([]byte{}, src...)
+		for k := 0; k < 1+i%4; k++ {
+			corrupt[2+random.Intn(len(corrupt)-2)] = byte(random.Intn(256))
+		}
+		inputs = append(inputs, corrupt)
+	}
+
+	// errors are expected, panics are not
+	for _, input := range inputs {
+		_, _ = _readJpegCoefficients(input)
+		_, _ = _losslessJpegTransform(info.Actions, input, "jpeg")
+		_, _ = _decodeJpegScaled(input, 4)
+	}
+}
+
+// _checkLosslessJpegTransform compares the lossless transform with the pixel path on the decoded source, false when
+// the transform falls back
+func _checkLosslessJpegTransform(t *testing.T, name string, src []byte, query string) bool {
+	t.Helper()
+	info := parseObjectProcessInfo(query)
+	out, ok := _losslessJpegTransform(info.Actions, src, "jpeg")
+	if !ok {
+		return false
+	}
+	got, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return true
+	}
+
+	// the pixel path runs on a png so it adds no loss of its own
+	decoded, err := jpeg.Decode(bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = png.Encode(buf, decoded); err != nil {
+		t.Fatal(err)
+	}
+	reader, _ := ProcessObject(bytes.NewReader(buf.Bytes()), "", query, nil)
+	result, _ := io.ReadAll(reader)
+	want, _, err := image.Decode(bytes.NewReader(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Bounds().Size() != want.Bounds().Size() {
+		t.Errorf("%s: size %v, want %v", name, got.Bounds().Size(), want.Bounds().Size())
+		return true
+	}
+	if diff := _testMaxDiff(want, got); diff > 3 {
+		t.Errorf("%s: differs by %d", name, diff)
+	}
+	return true
+}
+
+func _testImage(w, h int, gray bool) image.Image {
+	if gray {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.SetGray(x, y, color.Gray{Y: uint8((x*7 + y*13) % 256)})
+			}
+		}
+		return img
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: uint8((x / 4 * y / 4 * 37) % 256), A: 255})
+		}
+	}
+	return img
+}
+
+// _testJpeg encodes with the standard encoder, which subsamples color images 4:2:0
+func _testJpeg(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func _testMaxDiff(a, b image.Image) int {
+	max := 0
+	aMin, bMin := a.Bounds().Min, b.Bounds().Min
+	size := a.Bounds().Size()
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			c1 := color.NRGBAModel.Convert(a.At(aMin.X+x, aMin.Y+y)).(color.NRGBA)
+			c2 := color.NRGBAModel.Convert(b.At(bMin.X+x, bMin.Y+y)).(color.NRGBA)
+			for _, d := range []int{int(c1.R) - int(c2.R), int(c1.G) - int(c2.G), int(c1.B) - int(c2.B)} {
+				if d < 0 {
+					d = -d
+				}
+				if d > max {
+					max = d
+				}
+			}
+		}
+	}
+	return max
+}
@@ -0,0 +1,96 @@
+package process
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// jpegStdLuminanceTable the IJG luminance quantization table at quality 50, in zigzag order like DQT segments
+var jpegStdLuminanceTable = [64]int{
+	16, 11, 12, 14, 12, 10, 16, 14,
+	13, 14, 18, 17, 16, 19, 24, 40,
+	26, 24, 22, 22, 24, 49, 35, 37,
+	29, 40, 58, 51, 61, 60, 57, 51,
+	56, 55, 64, 72, 92, 78, 64, 68,
+	87, 69, 55, 56, 80, 109, 81, 87,
+	95, 98, 103, 104, 103, 62, 77, 113,
+	121, 112, 100, 120, 92, 101, 103, 99,
+}
+
+// _estimateJpegQuality estimates the IJG quality the JPEG was saved with from its luminance quantization table,
+// false when the buffer has no such table
+func _estimateJpegQuality(buffer []byte) (int, bool) {
+	table, ok := _readJpegLuminanceTable(buffer)
+	if !ok {
+		return 0, false
+	}
+
+	// IJG scales the standard table by 5000/q below quality 50 and by 200-2q above
+	sum := 0
+	stdSum := 0
+	for i := range table {
+		sum += table[i]
+		stdSum += jpegStdLuminanceTable[i]
+	}
+	scale := float64(sum) * 100 / float64(stdSum)
+	var q float64
+	if scale <= 100 {
+		q = (200 - scale) / 2
+	} else {
+		q = 5000 / scale
+	}
+	return int(math.Max(1, math.Min(100, math.Round(q)))), true
+}
+
+// _readJpegLuminanceTable returns quantization table 0 from the DQT segments before the image data
+func _readJpegLuminanceTable(buffer []byte) ([64]int, bool) {
+	var table [64]int
+	if len(buffer) < 4 || buffer[0] != 0xFF || buffer[1] != 0xD8 {
+		return table, false
+	}
+	i := 2
+	for i+4 <= len(buffer) {
+		if buffer[i] != 0xFF {
+			return table, false
+		}
+		marker := buffer[i+1]
+		if marker == 0xFF { // fill byte
+			i += 1
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // start of scan or end of image
+			return table, false
+		}
+		length := int(binary.BigEndian.Uint16(buffer[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(buffer) {
+			return table, false
+		}
+		if marker == 0xDB {
+			for p := i + 4; p < end; {
+				precision := buffer[p] >> 4
+				id := buffer[p] & 0x0F
+				size := 64
+				if precision != 0 {
+					size = 128
+				}
+				if p+1+size > end {
+					return table, false
+				}
+				if id == 0 {
+					for k := 0; k < 64; k++ {
+						if precision != 0 {
+							table[k] = int(binary.BigEndian.Uint16(buffer[p+1+k*2:]))
+						} else {
+							table[k] = int(buffer[p+1+k])
+						}
+					}
+					return table, true
+				}
+				p += 1 + size
+			}
+		}
+		i = end
+	}
+	return table, false
+}
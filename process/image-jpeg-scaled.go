@@ -0,0 +1,173 @@
+package process
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+)
+
+// _jpegShrinkScale returns the largest DCT scale of 8, 4 and 2 that still decodes the sW*sH JPEG at least as large
+// as the w*h it is resized to, 1 when the resize is not a large enough downscale
+func _jpegShrinkScale(sW, sH, w, h int) int {
+	for scale := 8; scale > 1; scale /= 2 {
+		if (sW+scale-1)/scale >= w && (sH+scale-1)/scale >= h {
+			return scale
+		}
+	}
+	return 1
+}
+
+// _isSequentialJpeg tells from the frame marker whether the JPEG is sequential Huffman coded, the only kind the
+// coefficient reader handles
+func _isSequentialJpeg(buffer []byte) bool {
+	if len(buffer) < 4 || buffer[0] != 0xFF || buffer[1] != 0xD8 {
+		return false
+	}
+	i := 2
+	for i+4 <= len(buffer) {
+		if buffer[i] != 0xFF {
+			return false
+		}
+		marker := buffer[i+1]
+		if marker == 0xFF { // fill byte
+			i += 1
+			continue
+		}
+		if marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC { // SOFn
+			return marker == 0xC0 || marker == 0xC1
+		}
+		if marker == 0xDA || marker == 0xD9 { // start of scan or end of image before a frame
+			return false
+		}
+		i += 2 + int(binary.BigEndian.Uint16(buffer[i+2:i+4]))
+	}
+	return false
+}
+
+// _decodeJpegScaled decodes a sequential Huffman JPEG at 1/scale of its size the way libjpeg does, by running a
+// reduced inverse DCT on the low frequencies of every block, so the full size image is never held in memory
+func _decodeJpegScaled(buffer []byte, scale int) (image.Image, error) {
+	if scale != 2 && scale != 4 && scale != 8 {
+		return nil, errors.New("jpeg: invalid scale")
+	}
+	c, err := _readJpeg(buffer, scale)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 8 / scale
+	rect := image.Rect(0, 0, (c.Width+scale-1)/scale, (c.Height+scale-1)/scale)
+	if len(c.Components) == 1 {
+		comp := c.Components[0]
+		return &image.Gray{Pix: comp.Plane, Stride: comp.BlocksW * size, Rect: rect}, nil
+	}
+
+	if _jpegAdobeTransform(c) == 0 {
+		return nil, errors.New("jpeg: RGB components are not supported")
+	}
+	lu, cb, cr := c.Components[0], c.Components[1], c.Components[2]
+	mcuW, mcuH := c.mcuSize()
+	if lu.H*8 != mcuW || lu.V*8 != mcuH || cb.H != 1 || cb.V != 1 || cr.H != 1 || cr.V != 1 {
+		return nil, errors.New("jpeg: unsupported sampling factors")
+	}
+	var ratio image.YCbCrSubsampleRatio
+	switch lu.H<<4 | lu.V {
+	case 0x11:
+		ratio = image.YCbCrSubsampleRatio444
+		break
+	case 0x21:
+		ratio = image.YCbCrSubsampleRatio422
+		break
+	case 0x22:
+		ratio = image.YCbCrSubsampleRatio420
+		break
+	case 0x12:
+		ratio = image.YCbCrSubsampleRatio440
+		break
+	case 0x41:
+		ratio = image.YCbCrSubsampleRatio411
+		break
+	case 0x42:
+		ratio = image.YCbCrSubsampleRatio410
+		break
+	default:
+		return nil, errors.New("jpeg: unsupported sampling factors")
+	}
+	return &image.YCbCr{
+		Y:              lu.Plane,
+		Cb:             cb.Plane,
+		Cr:             cr.Plane,
+		YStride:        lu.BlocksW * size,
+		CStride:        cb.BlocksW * size,
+		SubsampleRatio: ratio,
+		Rect:           rect,
+	}, nil
+}
+
+// _jpegAdobeTransform returns the color transform of the Adobe APP14 segment, 0 means the components are RGB and
+// not YCbCr, -1 when there is no such segment
+func _jpegAdobeTransform(c *jpegCoefficients) int {
+	for _, segment := range c.Segments {
+		if len(segment) >= 16 && segment[1] == 0xEE && string(segment[4:9]) == "Adobe" {
+			return int(segment[15])
+		}
+	}
+	return -1
+}
+
+// reduceBlock dequantizes a block and writes its 8/Scale * 8/Scale pixels to the component plane. Evaluating the
+// inverse DCT of the low frequencies at the center of every Scale*Scale pixel group gives their smoothed average.
+func (c *jpegCoefficients) reduceBlock(comp *jpegComponent, bx, by int, block *[64]int16) error {
+	quant := c.Quant[comp.Tq]
+	if quant == nil {
+		return errors.New("jpeg: missing quantization table")
+	}
+	size := 8 / c.Scale
+	stride := comp.BlocksW * size
+	offset := by*size*stride + bx*size
+
+	if size == 1 {
+		comp.Plane[offset] = _clampJpegSample(float64(block[0]) * float64(quant[0]) / 8)
+		return nil
+	}
+
+	if c.idct[0][0] == 0 {
+		for i := 0; i < size; i++ {
+			for u := 0; u < size; u++ {
+				k := 0.5
+				if u == 0 {
+					k = 0.5 / math.Sqrt2
+				}
+				c.idct[i][u] = k * math.Cos(float64((2*i+1)*u)*math.Pi/float64(2*size))
+			}
+		}
+	}
+
+	// rows first over the horizontal frequencies, then columns
+	var rows [8][8]float64
+	for v := 0; v < size; v++ {
+		for x := 0; x < size; x++ {
+			sum := 0.0
+			for u := 0; u < size; u++ {
+				sum += c.idct[x][u] * float64(block[v*8+u]) * float64(quant[v*8+u])
+			}
+			rows[v][x] = sum
+		}
+	}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			sum := 0.0
+			for v := 0; v < size; v++ {
+				sum += c.idct[y][v] * rows[v][x]
+			}
+			comp.Plane[offset+y*stride+x] = _clampJpegSample(sum)
+		}
+	}
+	return nil
+}
+
+// _clampJpegSample level shifts an inverse DCT output back to [0, 255]
+func _clampJpegSample(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v+128))))
+}
@@ -0,0 +1,286 @@
+package process
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestJpegShrinkScale(t *testing.T) {
+	cases := []struct {
+		sW, sH, w, h, scale int
+	}{
+		{6000, 4000, 750, 500, 8},
+		{6000, 4000, 751, 500, 4},
+		{6000, 4000, 200, 1000, 4},
+		{6000, 4000, 3000, 2000, 2},
+		{6000, 4000, 3001, 10, 1},
+		{6000, 4000, 6000, 4000, 1},
+		{6001, 4001, 751, 501, 8}, // partial blocks round up
+		{7, 7, 1, 1, 8},
+	}
+	for _, tc := range cases {
+		if scale := _jpegShrinkScale(tc.sW, tc.sH, tc.w, tc.h); scale != tc.scale {
+			t.Errorf("%dx%d to %dx%d: scale %d, want %d", tc.sW, tc.sH, tc.w, tc.h, scale, tc.scale)
+		}
+	}
+}
+
+func TestDecodeJpegScaled(t *testing.T) {
+	inputs := map[string][]byte{
+		"4:2:0": _testJpeg(t, _testSmoothImage(140, 100, false)),
+		"4:4:4": _testJpeg444(t, _testSmoothImage(140, 100, false)),
+		"gray":  _testJpeg(t, _testSmoothImage(140, 100, true)),
+	}
+	for name, src := range inputs {
+		full, err := jpeg.Decode(bytes.NewReader(src))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, scale := range []int{2, 4, 8} {
+			got, err := _decodeJpegScaled(src, scale)
+			if err != nil {
+				t.Errorf("%s 1/%d: %v", name, scale, err)
+				continue
+			}
+			want := _testShrink(full, scale)
+			if got.Bounds().Size() != want.Bounds().Size() {
+				t.Errorf("%s 1/%d: size %v, want %v", name, scale, got.Bounds().Size(), want.Bounds().Size())
+				continue
+			}
+			// the reduced inverse DCT smooths a little differently from a box filter, but not by much
+			if psnr := _testPsnr(want, got); psnr < 38 {
+				t.Errorf("%s 1/%d: PSNR %.1f dB against a full decode and downscale", name, scale, psnr)
+			}
+		}
+	}
+
+	if _, err := _decodeJpegScaled(inputs["4:2:0"], 3); err == nil {
+		t.Error("scale 3 was decoded")
+	}
+}
+
+func TestReduceBlock(t *testing.T) {
+	var quant [64]uint16
+	for i := range quant {
+		quant[i] = 1
+	}
+	random := rand.New(rand.NewSource(1))
+	for _, scale := range []int{2, 4, 8} {
+		size := 8 / scale
+		for n := 0; n < 50; n++ {
+			// the lowest frequencies, a box filter damps the higher ones more than the reduced inverse DCT does
+			var block [64]int16
+			block[0] = int16(random.Intn(1600) - 800)
+			if size > 1 {
+				block[1] = int16(random.Intn(120) - 60)
+				block[8] = int16(random.Intn(120) - 60)
+				block[9] = int16(random.Intn(120) - 60)
+			}
+
+			c := &jpegCoefficients{Scale: scale, Quant: [4]*[64]uint16{&quant}}
+			comp := &jpegComponent{BlocksW: 1, BlocksH: 1, Plane: make([]byte, size*size)}
+			if err := c.reduceBlock(comp, 0, 0, &block); err != nil {
+				t.Fatal(err)
+			}
+
+			full := _testIdct(&block)
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum := 0.0
+					for dy := 0; dy < scale; dy++ {
+						for dx := 0; dx < scale; dx++ {
+							sum += full[(y*scale+dy)*8+x*scale+dx]
+						}
+					}
+					want := _clampJpegSample(sum / float64(scale*scale))
+					if d := int(comp.Plane[y*size+x]) - int(want); d < -3 || d > 3 {
+						t.Fatalf("1/%d block %d pixel %d,%d: %d, want %d", scale, n, x, y, comp.Plane[y*size+x], want)
+					}
+				}
+			}
+		}
+	}
+
+	c := &jpegCoefficients{Scale: 2}
+	comp := &jpegComponent{Tq: 1, BlocksW: 1, BlocksH: 1, Plane: make([]byte, 16)}
+	if err := c.reduceBlock(comp, 0, 0, &[64]int16{}); err == nil {
+		t.Error("block without a quantization table was reduced")
+	}
+}
+
+// _testSmoothImage has only gradients, so box filtering and DCT smoothing agree up to rounding
+func _testSmoothImage(w, h int, gray bool) image.Image {
+	if gray {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.SetGray(x, y, color.Gray{Y: uint8(128 + 100*math.Sin(float64(x)/17)*math.Cos(float64(y)/23))})
+			}
+		}
+		return img
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(x * 255 / w),
+				G: uint8(y * 255 / h),
+				B: uint8(128 + 100*math.Sin(float64(x+y)/19)),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// _testJpeg444 writes a color JPEG without subsampling, which the standard encoder can't. Each channel is encoded as
+// a gray JPEG and the three coefficient sets are joined into one frame.
+func _testJpeg444(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	bounds := img.Bounds()
+	planes := []*image.Gray{image.NewGray(bounds), image.NewGray(bounds), image.NewGray(bounds)}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			lu, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			planes[0].SetGray(x, y, color.Gray{Y: lu})
+			planes[1].SetGray(x, y, color.Gray{Y: cb})
+			planes[2].SetGray(x, y, color.Gray{Y: cr})
+		}
+	}
+
+	var c *jpegCoefficients
+	for i, plane := range planes {
+		read, err := _readJpegCoefficients(_testJpeg(t, plane))
+		if err != nil {
+			t.Fatal(err)
+		}
+		comp := read.Components[0]
+		comp.ID = uint8(i + 1)
+		if c == nil {
+			c = read
+			continue
+		}
+		if *read.Quant[comp.Tq] != *c.Quant[comp.Tq] {
+			t.Fatal("gray encodes use different tables")
+		}
+		c.Components = append(c.Components, comp)
+	}
+
+	buf, err := _writeJpegCoefficients(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ColorModel != color.YCbCrModel {
+		t.Fatalf("joined JPEG is %v", config.ColorModel)
+	}
+	return buf
+}
+
+// _testShrink box filters by scale, the last row and column average the pixels they have. A YCbCr image is shrunk
+// plane by plane, so subsampled chroma keeps its own resolution like in the scaled decode.
+func _testShrink(img image.Image, scale int) image.Image {
+	bounds := img.Bounds()
+	w, h := (bounds.Dx()+scale-1)/scale, (bounds.Dy()+scale-1)/scale
+	if ycc, ok := img.(*image.YCbCr); ok && bounds.Min == (image.Point{}) {
+		cW, cH := bounds.Dx(), bounds.Dy()
+		if ycc.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+			cW, cH = (cW+1)/2, (cH+1)/2
+		}
+		lu, yStride := _testShrinkPlane(ycc.Y, ycc.YStride, bounds.Dx(), bounds.Dy(), scale)
+		cb, cStride := _testShrinkPlane(ycc.Cb, ycc.CStride, cW, cH, scale)
+		cr, _ := _testShrinkPlane(ycc.Cr, ycc.CStride, cW, cH, scale)
+		return &image.YCbCr{Y: lu, Cb: cb, Cr: cr, YStride: yStride, CStride: cStride, SubsampleRatio: ycc.SubsampleRatio, Rect: image.Rect(0, 0, w, h)}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [3]int
+			n := 0
+			for sy := y * scale; sy < (y+1)*scale && sy < bounds.Dy(); sy++ {
+				for sx := x * scale; sx < (x+1)*scale && sx < bounds.Dx(); sx++ {
+					c := color.RGBAModel.Convert(img.At(bounds.Min.X+sx, bounds.Min.Y+sy)).(color.RGBA)
+					sum[0] += int(c.R)
+					sum[1] += int(c.G)
+					sum[2] += int(c.B)
+					n += 1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(sum[0] / n), G: uint8(sum[1] / n), B: uint8(sum[2] / n), A: 255})
+		}
+	}
+	return dst
+}
+
+func _testShrinkPlane(pix []byte, stride, w, h, scale int) ([]byte, int) {
+	dW, dH := (w+scale-1)/scale, (h+scale-1)/scale
+	dst := make([]byte, dW*dH)
+	for y := 0; y < dH; y++ {
+		for x := 0; x < dW; x++ {
+			sum, n := 0, 0
+			for sy := y * scale; sy < (y+1)*scale && sy < h; sy++ {
+				for sx := x * scale; sx < (x+1)*scale && sx < w; sx++ {
+					sum += int(pix[sy*stride+sx])
+					n += 1
+				}
+			}
+			dst[y*dW+x] = uint8((sum + n/2) / n)
+		}
+	}
+	return dst, dW
+}
+
+func _testPsnr(a, b image.Image) float64 {
+	aMin, bMin := a.Bounds().Min, b.Bounds().Min
+	size := a.Bounds().Size()
+	sum := 0.0
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			c1 := color.RGBAModel.Convert(a.At(aMin.X+x, aMin.Y+y)).(color.RGBA)
+			c2 := color.RGBAModel.Convert(b.At(bMin.X+x, bMin.Y+y)).(color.RGBA)
+			for _, d := range []float64{float64(c1.R) - float64(c2.R), float64(c1.G) - float64(c2.G), float64(c1.B) - float64(c2.B)} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(size.X*size.Y*3)
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// _testIdct is the full 8x8 inverse DCT of a dequantized block, without the level shift
+func _testIdct(block *[64]int16) [64]float64 {
+	var out [64]float64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			sum := 0.0
+			for v := 0; v < 8; v++ {
+				for u := 0; u < 8; u++ {
+					cu, cv := 1.0, 1.0
+					if u == 0 {
+						cu = 1 / math.Sqrt2
+					}
+					if v == 0 {
+						cv = 1 / math.Sqrt2
+					}
+					sum += cu * cv * float64(block[v*8+u]) *
+						math.Cos(float64((2*x+1)*u)*math.Pi/16) * math.Cos(float64((2*y+1)*v)*math.Pi/16)
+				}
+			}
+			out[y*8+x] = sum / 4
+		}
+	}
+	return out
+}
@@ -0,0 +1,211 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// lutLock guards the directory, and keeps LUTs of an old directory out of the cache
+	lutLock      sync.RWMutex
+	lutDirectory string
+	lutCache     = newObjectCache(defLutCacheSize, defLutCacheTTL)
+)
+
+// colorLut3D
+// -----------
+// Parsed Adobe .cube 3D LUT, red changes fastest in Table
+type colorLut3D struct {
+	Size      int
+	DomainMin [3]float64
+	DomainMax [3]float64
+	Table     []float64
+}
+
+// SetLutDirectory sets the local directory the .cube files of the lut action are loaded from.
+// LUTs not found there are loaded with the object fetcher.
+func SetLutDirectory(dir string) {
+	lutLock.Lock()
+	defer lutLock.Unlock()
+	lutDirectory = dir
+	lutCache.Clear()
+}
+
+func LutImage(buffer []byte, bucket string, lutName *string, simpleType string) []byte {
+	if lutName == nil || *lutName == "" {
+		return buffer
+	}
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	lut, err := _loadLut(bucket, *lutName)
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	return _adjustImageBuffer(buffer, simpleType, lut.Apply)
+}
+
+// Apply maps a color with trilinear interpolation
+func (lut *colorLut3D) Apply(r, g, b float64) (float64, float64, float64) {
+	n := lut.Size
+	max := float64(n - 1)
+	var pos [3]float64
+	var i0, i1 [3]int
+	for k, c := range [3]float64{r, g, b} {
+		c = (c - lut.DomainMin[k]) / (lut.DomainMax[k] - lut.DomainMin[k])
+		c = math.Max(0, math.Min(1, c)) * max
+		i0[k] = int(math.Floor(c))
+		i1[k] = int(math.Min(max, float64(i0[k]+1)))
+		pos[k] = c - float64(i0[k])
+	}
+
+	at := func(ri, gi, bi int) []float64 {
+		i := (bi*n*n + gi*n + ri) * 3
+		return lut.Table[i : i+3]
+	}
+
+	var out [3]float64
+	for k := 0; k < 3; k++ {
+		c00 := at(i0[0], i0[1], i0[2])[k]*(1-pos[0]) + at(i1[0], i0[1], i0[2])[k]*pos[0]
+		c10 := at(i0[0], i1[1], i0[2])[k]*(1-pos[0]) + at(i1[0], i1[1], i0[2])[k]*pos[0]
+		c01 := at(i0[0], i0[1], i1[2])[k]*(1-pos[0]) + at(i1[0], i0[1], i1[2])[k]*pos[0]
+		c11 := at(i0[0], i1[1], i1[2])[k]*(1-pos[0]) + at(i1[0], i1[1], i1[2])[k]*pos[0]
+		c0 := c00*(1-pos[1]) + c10*pos[1]
+		c1 := c01*(1-pos[1]) + c11*pos[1]
+		out[k] = c0*(1-pos[2]) + c1*pos[2]
+	}
+	return out[0], out[1], out[2]
+}
+
+// _loadLut loads a .cube file, the cache is per bucket since the file may be an object of the bucket
+func _loadLut(bucket, name string) (*colorLut3D, error) {
+	cacheKey := bucket + "/" + name
+	lutLock.RLock()
+	defer lutLock.RUnlock()
+	if lut, ok := lutCache.Get(cacheKey); ok {
+		return lut.(*colorLut3D), nil
+	}
+
+	fileName := name
+	if !strings.HasSuffix(strings.ToLower(fileName), ".cube") {
+		fileName += ".cube"
+	}
+
+	var buffer []byte
+	var err error
+	path := ""
+	if lutDirectory != "" {
+		path = filepath.Join(lutDirectory, filepath.Base(filepath.Clean("/"+fileName)))
+	}
+	if stat, statErr := os.Stat(path); path != "" && statErr == nil && !stat.IsDir() {
+		buffer, err = ioutil.ReadFile(path)
+	} else {
+		buffer, err = fetchObject(bucket, fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lut, err := _parseCubeLut(bytes.NewReader(buffer))
+	if err != nil {
+		return nil, fmt.Errorf("lut %s: %v", name, err)
+	}
+	lutCache.Set(cacheKey, lut)
+	return lut, nil
+}
+
+func _parseCubeLut(reader io.Reader) (*colorLut3D, error) {
+	lut := &colorLut3D{
+		DomainMax: [3]float64{1, 1, 1},
+	}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch strings.ToUpper(fields[0]) {
+		case "TITLE":
+			continue
+		case "LUT_1D_SIZE":
+			return nil, errors.New("1D LUT is not supported")
+		case "LUT_3D_SIZE":
+			if len(fields) < 2 {
+				return nil, errors.New("invalid LUT_3D_SIZE")
+			}
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 2 || size > defLutMaxSize {
+				return nil, errors.New("invalid LUT_3D_SIZE")
+			}
+			lut.Size = size
+			lut.Table = make([]float64, 0, size*size*size*3)
+			continue
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			domain, err := _parseCubeTriple(fields[1:])
+			if err != nil {
+				return nil, err
+			}
+			if strings.ToUpper(fields[0]) == "DOMAIN_MIN" {
+				lut.DomainMin = domain
+			} else {
+				lut.DomainMax = domain
+			}
+			continue
+		}
+		if lut.Size == 0 {
+			return nil, errors.New("table data before LUT_3D_SIZE")
+		}
+		if len(lut.Table) >= lut.Size*lut.Size*lut.Size*3 {
+			return nil, errors.New("too many table entries")
+		}
+		value, err := _parseCubeTriple(fields)
+		if err != nil {
+			return nil, err
+		}
+		lut.Table = append(lut.Table, value[:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lut.Size == 0 || len(lut.Table) != lut.Size*lut.Size*lut.Size*3 {
+		return nil, errors.New("incomplete table")
+	}
+	for k := 0; k < 3; k++ {
+		if lut.DomainMax[k] <= lut.DomainMin[k] {
+			return nil, errors.New("invalid domain")
+		}
+	}
+	return lut, nil
+}
+
+func _parseCubeTriple(fields []string) ([3]float64, error) {
+	var v [3]float64
+	if len(fields) != 3 {
+		return v, fmt.Errorf("expected 3 values, got %d", len(fields))
+	}
+	for i := range v {
+		f, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return v, err
+		}
+		v[i] = f
+	}
+	return v, nil
+}
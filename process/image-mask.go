@@ -0,0 +1,124 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// MaskImage keeps the part of the image covered by a built-in shape or by the alpha of a mask image from the object
+// fetcher, the mask image is stretched to the image size. A mask image wins over shape.
+func MaskImage(buffer []byte, maskShape *ImageMaskShape, bucket string, maskKey *string, background *color.RGBA, formatType *ImageFormatType, simpleType string) (bufferT []byte, resultType string) {
+	resultType = simpleType
+	bufferT = buffer
+	if maskShape == nil && maskKey == nil {
+		return
+	}
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	bounds := imgSrc.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	var mask *image.Alpha
+	if maskKey != nil {
+		maskImg, err := fetchImage(bucket, *maskKey)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		mask = _imageToAlphaMask(resize.Resize(uint(width), uint(height), maskImg, resize.Bilinear))
+	} else {
+		mask = _drawShapeMask(width, height, *maskShape)
+	}
+
+	render := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.DrawMask(render, render.Bounds(), imgSrc, bounds.Min, mask, mask.Bounds().Min, draw.Over)
+
+	return _saveAlphaImage(buffer, render, background, formatType, simpleType)
+}
+
+// _drawShapeMask rasterizes the shape inscribed in w*h, each pixel is supersampled for smooth edges
+func _drawShapeMask(w, h int, shape ImageMaskShape) *image.Alpha {
+	// inside tests work on coordinates normalized to [-1, 1] from the center
+	var inside func(u, v float64) bool
+	switch shape {
+	case hexagonMask: // pointy top, the side corners at a quarter of the height
+		inside = func(u, v float64) bool {
+			u = math.Abs(u)
+			return u <= 1 && math.Abs(v) <= 1-u*0.5
+		}
+		break
+	case squircleMask: // superellipse with exponent 4
+		inside = func(u, v float64) bool {
+			return u*u*u*u+v*v*v*v <= 1
+		}
+		break
+	default:
+		inside = func(u, v float64) bool {
+			return true
+		}
+		break
+	}
+
+	mask := image.NewAlpha(image.Rect(0, 0, w, h))
+	n := defMaskSupersample
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			hit := 0
+			for sY := 0; sY < n; sY++ {
+				v := (float64(y)+(float64(sY)+0.5)/float64(n))/float64(h)*2 - 1
+				for sX := 0; sX < n; sX++ {
+					u := (float64(x)+(float64(sX)+0.5)/float64(n))/float64(w)*2 - 1
+					if inside(u, v) {
+						hit += 1
+					}
+				}
+			}
+			mask.Pix[y*mask.Stride+x] = uint8((hit*255 + n*n/2) / (n * n))
+		}
+	}
+	return mask
+}
+
+// _imageToAlphaMask uses the alpha of the mask image, or its luminance when it is fully opaque
+func _imageToAlphaMask(maskImg image.Image) *image.Alpha {
+	img := _toNRGBA(maskImg)
+	bounds := img.Bounds()
+	mask := image.NewAlpha(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	opaque := true
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 255 {
+			opaque = false
+			break
+		}
+	}
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			i := y*img.Stride + x*4
+			if opaque {
+				l := _computeLuma(float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2]))
+				mask.Pix[y*mask.Stride+x] = _fixColor(int32(math.Round(l)))
+			} else {
+				mask.Pix[y*mask.Stride+x] = img.Pix[i+3]
+			}
+		}
+	}
+	return mask
+}
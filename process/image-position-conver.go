@@ -8,7 +8,7 @@ import (
 	"math"
 )
 
-func RotateImage(buffer []byte, rotateValue *int64, simpleType string) []byte {
+func RotateImage(buffer []byte, rotateValue *int64, background *color.RGBA, interpolation *ImageInterpolation, cropToFit bool, simpleType string) []byte {
 	if rotateValue == nil {
 		return buffer
 	}
@@ -30,60 +30,188 @@ func RotateImage(buffer []byte, rotateValue *int64, simpleType string) []byte {
 		return buffer
 	}
 
+	// uncovered corners are transparent when the format can keep it
+	bg := color.RGBA{
+		A: 255,
+		R: 255,
+		G: 255,
+		B: 255,
+	}
+	if isPNG || isWebp || isGIF {
+		bg = color.RGBA{}
+	}
+	if background != nil {
+		bg = _premultiplyColor(*background)
+	}
+
+	interp := bilinearInterpolation
+	if interpolation != nil {
+		interp = *interpolation
+	}
+
+	imgTmp := _rotateImage(imgSrc, v, bg, interp)
+
+	if cropToFit {
+		bounds := imgSrc.Bounds()
+		rW, rH := _computeRotateInscribedSize(float64(bounds.Dx()), float64(bounds.Dy()), v)
+		tBounds := imgTmp.Bounds()
+		x := (tBounds.Dx() - rW) / 2
+		y := (tBounds.Dy() - rH) / 2
+		if cropImg := _cropImage(imgTmp, rW, rH, x, y); cropImg != nil {
+			imgTmp = cropImg
+		}
+	}
+
+	if isGIF && background == nil { // the plain gif encoder drops the transparent corners
+		buf, err := _encodeAlphaImage(imgTmp, isPNG, isJPEG, isGIF, isBMP, isWebp)
+		if err != nil {
+			fmt.Println(err)
+			return buffer
+		}
+		return buf
+	}
+	return _saveImage(buffer, imgTmp, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+// _rotateImage rotates clockwise by v degrees, right angles are exact pixel shuffles
+func _rotateImage(imgSrc image.Image, v float64, background color.RGBA, interpolation ImageInterpolation) image.Image {
 	bounds := imgSrc.Bounds()
 	sW := bounds.Dx()
 	sH := bounds.Dy()
 
-	hW := float64(sW) / 2
-	hH := float64(sH) / 2
+	if v == math.Trunc(v) {
+		switch (int(v)%360 + 360) % 360 {
+		case 0:
+			return imgSrc
+		case 90:
+			return _transformImage(imgSrc, sH, sW, func(x, y int) (int, int) {
+				return y, sH - 1 - x
+			})
+		case 180:
+			return _transformImage(imgSrc, sW, sH, func(x, y int) (int, int) {
+				return sW - 1 - x, sH - 1 - y
+			})
+		case 270:
+			return _transformImage(imgSrc, sH, sW, func(x, y int) (int, int) {
+				return sW - 1 - y, x
+			})
+		}
+	}
+
+	src := _toRGBA(imgSrc)
 
 	sin := math.Sin(v * math.Pi / 180)
 	cos := math.Cos(v * math.Pi / 180)
 
-	ltX, ltY := _computeRotatePosition(-hW, hH, sin, cos)
-	rtX, rtY := _computeRotatePosition(hW, hH, sin, cos)
-	lbX, lbY := _computeRotatePosition(-hW, -hH, sin, cos)
-	rbX, rbY := _computeRotatePosition(hW, -hH, sin, cos)
-
-	maxWidth := int(math.Max(math.Abs(rbX-ltX), math.Abs(rtX-lbX)))
-	maxHeight := int(math.Max(math.Abs(rbY-ltY), math.Abs(rtY-lbY)))
+	maxWidth := int(math.Ceil(math.Abs(float64(sW)*cos) + math.Abs(float64(sH)*sin) - 1e-9))
+	maxHeight := int(math.Ceil(math.Abs(float64(sW)*sin) + math.Abs(float64(sH)*cos) - 1e-9))
 
 	imgTmp := image.NewRGBA(image.Rect(0, 0, maxWidth, maxHeight))
 
 	halfWidth := float64(maxWidth) / 2
 	halfHeight := float64(maxHeight) / 2
-	sinR := math.Sin((360 - v) * math.Pi / 180)
-	cosR := math.Cos((360 - v) * math.Pi / 180)
+	hW := float64(sW) / 2
+	hH := float64(sH) / 2
 	for y := 0; y < maxHeight; y++ {
+		dY := float64(y) + 0.5 - halfHeight
 		for x := 0; x < maxWidth; x++ {
-			tX := int((float64(x)-halfWidth)*cosR + (-float64(y)+halfHeight)*sinR)
-			tY := int(-(float64(x)-halfWidth)*sinR + (-float64(y)+halfHeight)*cosR)
-			tXF := float64(tX)
-			tYF := float64(tY)
-			colour := color.RGBA{
-				A: 255,
-				R: 255,
-				G: 255,
-				B: 255,
-			}
-			if !(tXF > hW || tXF < -hW || tYF > hH || tYF < -hH) {
-				tXN := int(tXF + hW)
-				tYN := int(math.Abs(tYF - hH))
-				r, g, b, a := imgSrc.At(tXN, tYN).RGBA()
-				colour.A = uint8(a)
-				colour.R = uint8(r >> 8)
-				colour.G = uint8(g >> 8)
-				colour.B = uint8(b >> 8)
+			dX := float64(x) + 0.5 - halfWidth
+			// inverse mapping, pixel centers are at +0.5
+			tX := dX*cos + dY*sin + hW - 0.5
+			tY := -dX*sin + dY*cos + hH - 0.5
+			imgTmp.SetRGBA(x, y, _sampleRGBA(src, tX, tY, background, interpolation))
+		}
+	}
+
+	return imgTmp
+}
+
+// _computeRotateInscribedSize returns the largest axis-aligned rectangle inside a w*h rectangle rotated by v degrees
+func _computeRotateInscribedSize(w, h, v float64) (int, int) {
+	sin := math.Abs(math.Sin(v * math.Pi / 180))
+	cos := math.Abs(math.Cos(v * math.Pi / 180))
+	long, short := math.Max(w, h), math.Min(w, h)
+	var rW, rH float64
+	if short <= 2*sin*cos*long || math.Abs(sin-cos) < 1e-10 { // the short side touches both long sides
+		half := 0.5 * short
+		if w >= h {
+			rW, rH = half/sin, half/cos
+		} else {
+			rW, rH = half/cos, half/sin
+		}
+	} else {
+		cos2 := cos*cos - sin*sin
+		rW, rH = (w*cos-h*sin)/cos2, (h*cos-w*sin)/cos2
+	}
+	return int(math.Max(1, math.Floor(rW))), int(math.Max(1, math.Floor(rH)))
+}
+
+// _sampleRGBA reads the premultiplied color at a sub-pixel position, taps outside the image use the background
+func _sampleRGBA(src *image.RGBA, x, y float64, background color.RGBA, interpolation ImageInterpolation) color.RGBA {
+	w := src.Rect.Dx()
+	h := src.Rect.Dy()
+	tap := func(tX, tY int) [4]float64 {
+		if tX < 0 || tY < 0 || tX >= w || tY >= h {
+			return [4]float64{float64(background.R), float64(background.G), float64(background.B), float64(background.A)}
+		}
+		i := tY*src.Stride + tX*4
+		p := src.Pix[i : i+4 : i+4]
+		return [4]float64{float64(p[0]), float64(p[1]), float64(p[2]), float64(p[3])}
+	}
+
+	var c [4]float64
+	switch interpolation {
+	case nearestInterpolation:
+		c = tap(int(math.Floor(x+0.5)), int(math.Floor(y+0.5)))
+		break
+	case bicubicInterpolation:
+		x0 := int(math.Floor(x))
+		y0 := int(math.Floor(y))
+		fX := x - float64(x0)
+		fY := y - float64(y0)
+		for j := -1; j <= 2; j++ {
+			wY := _cubicWeight(float64(j) - fY)
+			for i := -1; i <= 2; i++ {
+				wXY := _cubicWeight(float64(i)-fX) * wY
+				t := tap(x0+i, y0+j)
+				for k := range c {
+					c[k] += t[k] * wXY
+				}
 			}
-			imgTmp.SetRGBA(x, y, colour)
 		}
+		break
+	default:
+		x0 := int(math.Floor(x))
+		y0 := int(math.Floor(y))
+		fX := x - float64(x0)
+		fY := y - float64(y0)
+		t00 := tap(x0, y0)
+		t10 := tap(x0+1, y0)
+		t01 := tap(x0, y0+1)
+		t11 := tap(x0+1, y0+1)
+		for k := range c {
+			c[k] = (t00[k]*(1-fX)+t10[k]*fX)*(1-fY) + (t01[k]*(1-fX)+t11[k]*fX)*fY
+		}
+		break
 	}
 
-	return _saveImage(buffer, imgTmp, isPNG, isJPEG, isGIF, isBMP, isWebp)
+	a := math.Max(0, math.Min(255, c[3]))
+	return color.RGBA{
+		R: uint8(math.Round(math.Max(0, math.Min(a, c[0])))),
+		G: uint8(math.Round(math.Max(0, math.Min(a, c[1])))),
+		B: uint8(math.Round(math.Max(0, math.Min(a, c[2])))),
+		A: uint8(math.Round(a)),
+	}
 }
 
-func _computeRotatePosition(x, y, sin, cos float64) (float64, float64) {
-	x0 := x*cos + y*sin
-	y0 := -x*sin + y*cos
-	return x0, y0
+// _cubicWeight Catmull-Rom kernel
+func _cubicWeight(t float64) float64 {
+	t = math.Abs(t)
+	if t < 1 {
+		return 1.5*t*t*t - 2.5*t*t + 1
+	}
+	if t < 2 {
+		return -0.5*t*t*t + 2.5*t*t - 4*t + 2
+	}
+	return 0
 }
@@ -3,14 +3,21 @@ package process
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/chai2010/webp"
 	"golang.org/x/image/bmp"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
+	"net/http"
 	"regexp"
+	"strconv"
+	"time"
 )
 
 // ImageResizeMode
@@ -37,12 +44,140 @@ const (
 	gifType
 	bmpType
 	webpType
+	// picked per request from the Accept header and the image
+	autoType
+	// the smallest of several encodings that keeps the quality
+	smallestType
 )
 
+// ImageGravity
+// -----------
+// Image anchor position in a 3x3 grid
+type ImageGravity int
+
+const (
+	northWest ImageGravity = iota
+	north
+	northEast
+	west
+	center
+	east
+	southWest
+	south
+	southEast
+	// picked from the image content, only crop and resize fill support it
+	autoGravity
+)
+
+// ImageInterpolation
+// -----------
+// Pixel sampling used when an image is transformed
+type ImageInterpolation int
+
 const (
-	defCompressMin             = 40
-	defCompressMax             = 90
-	defContrastThreshold int32 = 128
+	nearestInterpolation ImageInterpolation = iota
+	bilinearInterpolation
+	bicubicInterpolation
+)
+
+// ImageFlipMode
+// -----------
+// Image flip direction
+type ImageFlipMode int
+
+const (
+	flipHorizontal ImageFlipMode = iota
+	flipVertical
+	flipBoth
+)
+
+// ImageWatermarkInfo
+// -----------
+// Image watermark params
+type ImageWatermarkInfo struct {
+	Text     *string
+	FontType *string
+	FontSize *int64
+	Opacity  *int64
+	Rotate   *int64
+	Shadow   *int64
+	Fill     bool
+
+	Image        *string
+	ImagePercent *int64
+}
+
+// ImageMaskShape
+// -----------
+// Built-in shape of the mask action, inscribed in the image
+type ImageMaskShape int
+
+const (
+	hexagonMask ImageMaskShape = iota
+	squircleMask
+)
+
+// ImageRegionShape
+// -----------
+// Shape of a region inside its bounding rectangle
+type ImageRegionShape int
+
+const (
+	rectRegion ImageRegionShape = iota
+	ellipseRegion
+)
+
+// ImageRegion
+// -----------
+// Area a region action is applied to, a zero width or height reaches the image edge
+type ImageRegion struct {
+	X      int64
+	Y      int64
+	Width  int64
+	Height int64
+	Shape  ImageRegionShape
+}
+
+const (
+	defCompressMin                 = 40
+	defCompressMax                 = 90
+	defContrastThreshold     int32 = 128
+	defThreshold                   = 128
+	defWatermarkFontType           = "wqy-zenhei"
+	defWatermarkFontSize           = 40
+	defWatermarkMargin             = 10
+	defWatermarkMaxPixels          = 16 * 1024 * 1024
+	defFetchedImageCacheSize       = 64
+	defFetchedImageCacheTTL        = 5 * time.Minute
+	defPaletteColorCount           = 5
+	defPaletteSampleSize           = 128
+	defBlurRadius                  = 3
+	defBlurSigma                   = 2
+	defUsmRadius                   = 1
+	defUsmAmount                   = 1
+	defUsmThreshold                = 0
+	defSharpenRadius               = 1.0
+	defSharpenThreshold            = 2
+	defLutCacheSize                = 32
+	defLutCacheTTL                 = 30 * time.Minute
+	defLutMaxSize                  = 65
+	defJpegMaxPixels               = 64 * 1024 * 1024
+	defAutoLevelsClip              = 0.5
+	defEqualizeTiles               = 8
+	defEqualizeClipLimit           = 2.0
+	defTrimTolerance               = 10
+	defMosaicBlockSize             = 16
+	defRegionBlurRadius            = 20
+	defRegionBlurSigma             = 10
+	defMaskSupersample             = 4
+	defTargetSizeQualityMin        = 10
+	defTargetSizeQualityMax        = 95
+	defTargetSizeScaleStep         = 0.8
+	defTargetSizeMinSide           = 16
+	defTargetSsim                  = 0.98
+	defAutoFormatQuality           = 80
+	defSmallestFormatQuality       = 80
+	defSmallestFormatSsim          = 0.95
 )
 
 // goCompressGif
@@ -51,6 +186,13 @@ type goCompressGif struct {
 	Result image.Paletted
 }
 
+// goFormatCandidate
+type goFormatCandidate struct {
+	Type   string
+	Result []byte
+	Ssim   float64
+}
+
 func checkImageType(simpleType string) (bool, bool, bool, bool, bool) {
 	v := []byte(simpleType)
 	isPNG := regexp.MustCompile(`(?i)png`).Match(v)
@@ -62,13 +204,88 @@ func checkImageType(simpleType string) (bool, bool, bool, bool, bool) {
 }
 
 // roundedCorner
+// -----------
+// Anti-aliased alpha mask of a rectangle with rounded corners, or of the ellipse inscribed in it
 type roundedCorner struct {
 	Width  int
 	Height int
-	Radius int
+
+	TopLeft     int
+	TopRight    int
+	BottomRight int
+	BottomLeft  int
+
+	Ellipse bool
+}
+
+func _computeGravityPosition(width, height, w, h, x, y int, gravity ImageGravity) (int, int) {
+	left := x
+	top := y
+	switch gravity {
+	case north, center, south:
+		left = (width - w) / 2
+		break
+	case northEast, east, southEast:
+		left = width - w - x
+		break
+	}
+	switch gravity {
+	case west, center, east:
+		top = (height - h) / 2
+		break
+	case southWest, south, southEast:
+		top = height - h - y
+		break
+	}
+	return left, top
+}
+
+// _toRGBA returns the image as premultiplied RGBA with bounds starting at (0, 0)
+func _toRGBA(imgSrc image.Image) *image.RGBA {
+	bounds := imgSrc.Bounds()
+	if rgbImg, ok := imgSrc.(*image.RGBA); ok && bounds.Min == (image.Point{}) {
+		return rgbImg
+	}
+	rgbImg := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgbImg, rgbImg.Bounds(), imgSrc, bounds.Min, draw.Src)
+	return rgbImg
+}
+
+// _toNRGBA returns a copy of the image as straight (not premultiplied) RGBA with bounds starting at (0, 0)
+func _toNRGBA(imgSrc image.Image) *image.NRGBA {
+	bounds := imgSrc.Bounds()
+	nrgbImg := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgbImg, nrgbImg.Bounds(), imgSrc, bounds.Min, draw.Src)
+	return nrgbImg
+}
+
+// _premultiplyColor converts a color parsed by hexToRGBA, whose alpha is not applied yet
+func _premultiplyColor(c color.RGBA) color.RGBA {
+	return color.RGBAModel.Convert(color.NRGBA(c)).(color.RGBA)
+}
+
+// _flattenColor blends a color parsed by hexToRGBA onto white, like _saveAlphaImage flattens for jpeg and bmp
+func _flattenColor(c color.RGBA) color.RGBA {
+	a := int(c.A)
+	return color.RGBA{
+		R: uint8((int(c.R)*a + 255*(255-a)) / 255),
+		G: uint8((int(c.G)*a + 255*(255-a)) / 255),
+		B: uint8((int(c.B)*a + 255*(255-a)) / 255),
+		A: 255,
+	}
 }
 
 func _saveImage(buffer []byte, rgbImg image.Image, isPNG bool, isJPEG bool, isGIF bool, isBMP bool, isWebp bool) []byte {
+	buf, err := _encodeImage(rgbImg, isPNG, isJPEG, isGIF, isBMP, isWebp)
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+	return buf
+}
+
+// _encodeImage encodes like _saveImage, but reports the error instead of falling back to the input
+func _encodeImage(rgbImg image.Image, isPNG bool, isJPEG bool, isGIF bool, isBMP bool, isWebp bool) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 	writer := bufio.NewWriter(buf)
 	var err error
@@ -88,47 +305,130 @@ func _saveImage(buffer []byte, rgbImg image.Image, isPNG bool, isJPEG bool, isGI
 	case isWebp:
 		err = webp.Encode(writer, rgbImg, &webp.Options{Lossless: true, Quality: 100})
 		break
+	default:
+		return nil, errors.New("not support type")
 	}
 	if err != nil {
-		fmt.Println(err)
-		return buffer
+		return nil, err
 	}
 	_ = writer.Flush()
 
-	return buf.Bytes()
+	return buf.Bytes(), nil
 }
 
-func ProcessImage(processInfo ObjectProcessInfo, objectType ObjectTypeInfo, buffer *[]byte, contentType *string) {
+// _encodeAlphaImage encodes like _encodeImage for the actions that cut out transparent areas, gif keeps them
+func _encodeAlphaImage(img image.Image, isPNG bool, isJPEG bool, isGIF bool, isBMP bool, isWebp bool) ([]byte, error) {
+	if !isGIF {
+		return _encodeImage(img, isPNG, isJPEG, isGIF, isBMP, isWebp)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := _encodeGif(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// _encodeGif keeps transparency, gif.Encode alone maps every pixel into the opaque Plan9 palette. Only the alpha
+// actions and the format action use it, other actions keep the plain gif encoder.
+func _encodeGif(writer io.Writer, img image.Image) error {
+	if _, ok := img.(*image.Paletted); ok {
+		return gif.Encode(writer, img, nil)
+	}
+	if opaqueImg, ok := img.(interface{ Opaque() bool }); ok && opaqueImg.Opaque() {
+		return gif.Encode(writer, img, nil)
+	}
+
+	// gif has no partial transparency, each pixel is either kept opaque or dropped
+	nrgbImg := _toNRGBA(img)
+	for i := 0; i < len(nrgbImg.Pix); i += 4 {
+		if nrgbImg.Pix[i+3] < 128 {
+			nrgbImg.Pix[i], nrgbImg.Pix[i+1], nrgbImg.Pix[i+2], nrgbImg.Pix[i+3] = 0, 0, 0, 0
+		} else {
+			nrgbImg.Pix[i+3] = 255
+		}
+	}
+	bounds := nrgbImg.Bounds()
+	cmpImg := _compressPng(nrgbImg, bounds.Dx(), bounds.Dy(), 0, 100)
+	if cmpImg == nil {
+		return gif.Encode(writer, nrgbImg, nil)
+	}
+	return gif.Encode(writer, cmpImg, nil)
+}
+
+func ProcessImage(processInfo ObjectProcessInfo, objectType ObjectTypeInfo, buffer *[]byte, contentType *string, requestHeader, responseHeader http.Header) {
 	bf := *buffer
 	ct := *contentType
 	actions := processInfo.Actions
+	if buf, ok := _losslessJpegTransform(actions, bf, objectType.SimpleType); ok {
+		*buffer = buf
+		return
+	}
+	// relative qualities refer to the original object, not to a buffer an earlier action re-encoded
+	sourceQuality, _ := _estimateJpegQuality(bf)
 	for i := range actions {
 		simpleType := objectType.SimpleType
 		action := actions[i]
 		switch action.Action {
 		case ImageCropAction: // crop
-			bf = CropImage(bf, action.ImageWidth, action.ImageHeight, action.ImagePositionX, action.ImagePositionY, simpleType)
+			bf = CropImage(bf, action.ImageWidth, action.ImageHeight, action.ImagePositionX, action.ImagePositionY, action.ImageGravity, simpleType)
 			break
 		case ImageResizeAction: // resize
-			bf = ResizeImage(bf, action.ImageWidth, action.ImageHeight, action.ImageResizeMode, action.ImageColor, simpleType)
+			// only the original object is worth decoding at a reduced size, later buffers were re-encoded
+			bf = ResizeImage(bf, action.ImageWidth, action.ImageHeight, action.ImageResizeMode, action.ImageColor, action.ImageGravity, i == 0, simpleType)
 			break
 		case ImageCompressAction: // compress
-			bf = CompressImage(bf, action.ImageQualityMin, action.ImageQualityMax, simpleType)
+			if action.ImageTargetSsim == nil && action.ImageTargetSize == nil {
+				bf = CompressImage(bf, action.ImageQualityMin, action.ImageQualityMax, action.ImageQualityRelative, sourceQuality, simpleType)
+				break
+			}
+			if action.ImageTargetSsim != nil { // searched under the size limit too, the size wins over ssim
+				buf, score, ok := CompressImageToSsim(bf, action.ImageTargetSsim, action.ImageTargetSize, action.ImageQualityMin, action.ImageQualityMax, action.ImageQualityRelative, sourceQuality, action.ImageTargetSizeScale, simpleType)
+				if ok {
+					bf = buf
+					responseHeader.Set("X-Image-Ssim", strconv.FormatFloat(score, 'f', 4, 64))
+				}
+				break
+			}
+			bf = CompressImageToSize(bf, action.ImageTargetSize, action.ImageQualityMin, action.ImageQualityMax, action.ImageQualityRelative, sourceQuality, action.ImageTargetSizeScale, simpleType)
 			break
 		case ImageFormatAction: // format
+			if action.ImageFormatType != nil && *action.ImageFormatType == autoType {
+				// the response depends on the Accept header, caches have to know
+				responseHeader.Add("Vary", "Accept")
+				buf, resultType := AutoFormatImage(bf, requestHeader.Get("Accept"), simpleType)
+				bf = buf
+				objectType.SimpleType = resultType
+				ct = fmt.Sprintf("image/%s", resultType)
+				break
+			}
+			if action.ImageFormatType != nil && *action.ImageFormatType == smallestType {
+				// webp competes only when the client accepts it
+				responseHeader.Add("Vary", "Accept")
+				buf, resultType := SmallestFormatImage(bf, action.ImageQualityMax, action.ImageTargetSsim, requestHeader.Get("Accept"), simpleType)
+				bf = buf
+				objectType.SimpleType = resultType
+				ct = fmt.Sprintf("image/%s", resultType)
+				break
+			}
 			buf, resultType := FormatImage(bf, action.ImageFormatType, simpleType)
 			bf = buf
 			objectType.SimpleType = resultType
 			ct = fmt.Sprintf("image/%s", resultType)
 			break
 		case ImageCircleCropAction: // circle crop
-			buf, resultType := CircleCropImage(bf, action.ImageRadius, processInfo.LastImageFormatType, simpleType)
+			buf, resultType := CircleCropImage(bf, action.ImageRadius, action.ImageEllipse, action.ImageColor, processInfo.LastImageFormatType, simpleType)
+			bf = buf
+			objectType.SimpleType = resultType
+			ct = fmt.Sprintf("image/%s", resultType)
+			break
+		case ImageMaskAction: // mask
+			buf, resultType := MaskImage(bf, action.ImageMaskShape, processInfo.Bucket, action.ImageMaskImage, action.ImageColor, processInfo.LastImageFormatType, simpleType)
 			bf = buf
 			objectType.SimpleType = resultType
 			ct = fmt.Sprintf("image/%s", resultType)
 			break
 		case ImageRoundedCornersCropAction: // rounded-corner crop
-			buf, resultType := RoundedCornerCropImage(bf, action.ImageRadius, processInfo.LastImageFormatType, simpleType)
+			buf, resultType := RoundedCornerCropImage(bf, action.ImageRadius, action.ImageRadiusTopLeft, action.ImageRadiusTopRight, action.ImageRadiusBottomRight, action.ImageRadiusBottomLeft, action.ImageColor, processInfo.LastImageFormatType, simpleType)
 			bf = buf
 			objectType.SimpleType = resultType
 			ct = fmt.Sprintf("image/%s", resultType)
@@ -139,12 +439,99 @@ func ProcessImage(processInfo ObjectProcessInfo, objectType ObjectTypeInfo, buff
 		case ImageContrastAction: // contrast
 			bf = ContrastImage(bf, action.ImageValue, simpleType)
 			break
+		case ImageGrayscaleAction: // grayscale
+			bf = GrayscaleImage(bf, simpleType)
+			break
+		case ImageSepiaAction: // sepia
+			bf = SepiaImage(bf, simpleType)
+			break
+		case ImageInvertAction: // invert
+			bf = InvertImage(bf, simpleType)
+			break
+		case ImageThresholdAction: // black and white
+			bf = ThresholdImage(bf, action.ImageValue, simpleType)
+			break
+		case ImageDuotoneAction: // duotone
+			bf = DuotoneImage(bf, action.ImageColor, action.ImageHighlightColor, simpleType)
+			break
+		case ImageLutAction: // 3D LUT
+			bf = LutImage(bf, processInfo.Bucket, action.ImageLutName, simpleType)
+			break
+		case ImageAutoLevelsAction: // auto levels
+			bf = AutoLevelsImage(bf, action.ImageAmount, simpleType)
+			break
+		case ImageAutoContrastAction: // auto contrast
+			bf = AutoContrastImage(bf, action.ImageAmount, simpleType)
+			break
+		case ImageEqualizeAction: // histogram equalization
+			bf = EqualizeImage(bf, action.ImageEqualizeAdaptive, action.ImageValue, action.ImageAmount, simpleType)
+			break
+		case ImageSaturationAction: // saturation
+			bf = SaturationImage(bf, action.ImageValue, simpleType)
+			break
+		case ImageHueAction: // hue
+			bf = HueImage(bf, action.ImageValue, simpleType)
+			break
+		case ImageGammaAction: // gamma
+			bf = GammaImage(bf, action.ImageAmount, simpleType)
+			break
+		case ImageExposureAction: // exposure
+			bf = ExposureImage(bf, action.ImageAmount, simpleType)
+			break
 		case ImageRotateAction: // rotate
-			bf = RotateImage(bf, action.ImageValue, simpleType)
+			bf = RotateImage(bf, action.ImageValue, action.ImageColor, action.ImageInterpolation, action.ImageRotateCrop, simpleType)
 			break
 		case ImageSharpenAction: // sharpen
 			bf = SharpenImage(bf, action.ImageValue, simpleType)
 			break
+		case ImageBlurAction: // blur
+			bf = BlurImage(bf, action.ImageRadius, action.ImageValue, simpleType)
+			break
+		case ImageMosaicAction: // mosaic
+			bf = MosaicImage(bf, action.ImageRegions, action.ImageValue, simpleType)
+			break
+		case ImageBlurRegionAction: // blur regions
+			bf = BlurRegionImage(bf, action.ImageRegions, action.ImageRadius, action.ImageValue, simpleType)
+			break
+		case ImageUnsharpMaskAction: // unsharp mask
+			bf = UnsharpMaskImage(bf, action.ImageSigma, action.ImageAmount, action.ImageValue, simpleType)
+			break
+		case ImageWatermarkAction: // watermark
+			bf = WatermarkImage(bf, processInfo.Bucket, action.ImageWatermark, action.ImageColor, action.ImageGravity, action.ImagePositionX, action.ImagePositionY, simpleType)
+			break
+		case ImageExtendAction: // extend canvas or border
+			bf = ExtendImage(bf, action.ImageExtendTop, action.ImageExtendRight, action.ImageExtendBottom, action.ImageExtendLeft, action.ImageColor, simpleType)
+			break
+		case ImageTrimAction: // trim
+			bf = TrimImage(bf, action.ImageValue, action.ImageColor, action.ImagePadding, simpleType)
+			break
+		case ImageFlipAction: // flip
+			bf = FlipImage(bf, action.ImageFlipMode, simpleType)
+			break
+		case ImageTransposeAction: // transpose
+			bf = TransposeImage(bf, simpleType)
+			break
+		case ImageInfoAction: // info, the result is no longer an image
+			if buf, ok := ImageInfo(bf, simpleType); ok {
+				bf = buf
+				objectType.SimpleType = "json"
+				ct = "application/json"
+			}
+			break
+		case ImageAverageHueAction: // average hue, the result is no longer an image
+			if buf, ok := AverageHueImage(bf, simpleType); ok {
+				bf = buf
+				objectType.SimpleType = "json"
+				ct = "application/json"
+			}
+			break
+		case ImagePaletteAction: // dominant colors, the result is no longer an image
+			if buf, ok := PaletteImage(bf, action.ImageValue, simpleType); ok {
+				bf = buf
+				objectType.SimpleType = "json"
+				ct = "application/json"
+			}
+			break
 		}
 	}
 	*buffer = bf
@@ -0,0 +1,144 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+)
+
+// MosaicImage pixelates the regions with square blocks
+func MosaicImage(buffer []byte, regions []ImageRegion, blockSize *int64, simpleType string) []byte {
+	size := defMosaicBlockSize
+	if blockSize != nil {
+		size = int(*blockSize)
+	}
+	return _regionImageBuffer(buffer, regions, simpleType, func(img *image.RGBA, rect image.Rectangle) *image.RGBA {
+		return _pixelate(img, rect, size)
+	})
+}
+
+// BlurRegionImage gaussian blurs the regions
+func BlurRegionImage(buffer []byte, regions []ImageRegion, blurRadius, blurSigma *int64, simpleType string) []byte {
+	radius := defRegionBlurRadius
+	sigma := float64(defRegionBlurSigma)
+	if blurRadius != nil {
+		radius = int(*blurRadius)
+	}
+	if blurSigma != nil {
+		sigma = float64(*blurSigma)
+	}
+	return _regionImageBuffer(buffer, regions, simpleType, func(img *image.RGBA, rect image.Rectangle) *image.RGBA {
+		// blur a margin around the region too, so its border samples the real neighbours instead of clamped edges
+		outer := rect.Inset(-radius).Intersect(img.Bounds())
+		blurImg := _gaussianBlur(img.SubImage(outer).(*image.RGBA), radius, sigma)
+		offset := rect.Min.Sub(outer.Min)
+		return blurImg.SubImage(image.Rectangle{Min: offset, Max: offset.Add(rect.Size())}).(*image.RGBA)
+	})
+}
+
+// _regionImageBuffer replaces each region with the result of fn, fn gets the region bounds and returns an image of
+// the same size. A region needs w or h, so a missing region never covers the whole image.
+func _regionImageBuffer(buffer []byte, regions []ImageRegion, simpleType string, fn func(img *image.RGBA, rect image.Rectangle) *image.RGBA) []byte {
+	sized := false
+	for _, region := range regions {
+		sized = sized || region.Width != 0 || region.Height != 0
+	}
+	if !sized {
+		return buffer
+	}
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	img := _toRGBA(imgSrc)
+	bounds := img.Bounds()
+	changed := false
+	for _, region := range regions {
+		if region.Width == 0 && region.Height == 0 {
+			continue
+		}
+		rect := image.Rect(int(region.X), int(region.Y), int(region.X+region.Width), int(region.Y+region.Height))
+		if region.Width == 0 {
+			rect.Max.X = bounds.Max.X
+		}
+		if region.Height == 0 {
+			rect.Max.Y = bounds.Max.Y
+		}
+		rect = rect.Intersect(bounds)
+		if rect.Empty() {
+			continue
+		}
+		_blendRegion(img, rect, fn(img, rect), region.Shape)
+		changed = true
+	}
+	if !changed {
+		return buffer
+	}
+
+	return _saveImage(buffer, img, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+// _blendRegion copies src into the rect of dst, ellipses get an anti-aliased edge
+func _blendRegion(dst *image.RGBA, rect image.Rectangle, src *image.RGBA, shape ImageRegionShape) {
+	a := float64(rect.Dx()) / 2
+	b := float64(rect.Dy()) / 2
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			coverage := 1.0
+			if shape == ellipseRegion {
+				dX := (float64(x) + 0.5 - a) / a
+				dY := (float64(y) + 0.5 - b) / b
+				// distance to the edge in pixels, roughly
+				coverage = math.Max(0, math.Min(1, 0.5+(1-math.Hypot(dX, dY))*math.Min(a, b)))
+				if coverage == 0 {
+					continue
+				}
+			}
+			s := src.PixOffset(src.Rect.Min.X+x, src.Rect.Min.Y+y)
+			d := dst.PixOffset(rect.Min.X+x, rect.Min.Y+y)
+			for k := 0; k < 4; k++ {
+				dst.Pix[d+k] = uint8(math.Round(float64(src.Pix[s+k])*coverage + float64(dst.Pix[d+k])*(1-coverage)))
+			}
+		}
+	}
+}
+
+// _pixelate fills blocks aligned to the region origin with their average color
+func _pixelate(img *image.RGBA, rect image.Rectangle, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	for bY := 0; bY < rect.Dy(); bY += size {
+		for bX := 0; bX < rect.Dx(); bX += size {
+			block := image.Rect(bX, bY, bX+size, bY+size).Intersect(dst.Rect)
+			var sum [4]int
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					i := img.PixOffset(rect.Min.X+x, rect.Min.Y+y)
+					for k := 0; k < 4; k++ {
+						sum[k] += int(img.Pix[i+k])
+					}
+				}
+			}
+			n := block.Dx() * block.Dy()
+			var c [4]uint8
+			for k := range c {
+				c[k] = uint8((sum[k] + n/2) / n)
+			}
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					copy(dst.Pix[dst.PixOffset(x, y):], c[:])
+				}
+			}
+		}
+	}
+	return dst
+}
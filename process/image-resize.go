@@ -9,12 +9,13 @@ import (
 	"image/color"
 	"image/draw"
 	_ "image/gif"
-	_ "image/jpeg"
+	"image/jpeg"
 	_ "image/png"
 	"math"
 )
 
-func ResizeImage(buffer []byte, resizeWidth, resizeHeight *int64, resizeMode *ImageResizeMode, padColor *color.RGBA, simpleType string) []byte {
+// ResizeImage resizes by the mode, shrinkOnLoad lets a large downscale of a JPEG decode it at a reduced size
+func ResizeImage(buffer []byte, resizeWidth, resizeHeight *int64, resizeMode *ImageResizeMode, padColor *color.RGBA, gravity *ImageGravity, shrinkOnLoad bool, simpleType string) []byte {
 	if resizeWidth == nil && resizeHeight == nil {
 		return buffer
 	}
@@ -51,15 +52,20 @@ func ResizeImage(buffer []byte, resizeWidth, resizeHeight *int64, resizeMode *Im
 		return buffer
 	}
 
-	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
-	if err != nil {
-		fmt.Println(err)
-		return buffer
+	// a large downscale of a JPEG is decoded at a reduced size, the sizes below still come from the full image
+	imgSrc, sW, sH := _decodeJpegForResize(buffer, w, h, m, shrinkOnLoad && isJPEG)
+	if imgSrc == nil {
+		var err error
+		imgSrc, _, err = image.Decode(bytes.NewReader(buffer))
+		if err != nil {
+			fmt.Println(err)
+			return buffer
+		}
+		bounds := imgSrc.Bounds()
+		sW = bounds.Dx()
+		sH = bounds.Dy()
 	}
 
-	bounds := imgSrc.Bounds()
-	sW := bounds.Dx()
-	sH := bounds.Dy()
 	sWF := float64(sW)
 	sHF := float64(sH)
 	wR := wF / sWF
@@ -79,7 +85,7 @@ func ResizeImage(buffer []byte, resizeWidth, resizeHeight *int64, resizeMode *Im
 		rW := uint(sWF * ratio)
 		rH := uint(sHF * ratio)
 		imgSrc = resize.Resize(rW, rH, imgSrc, resize.NearestNeighbor)
-		imgSrc = drawWrap(imgSrc, w, h, int(math.Abs((wF-float64(rW))*0.5)), int(math.Abs((hF-float64(rH))*0.5)), padColor)
+		imgSrc = drawWrap(imgSrc, w, h, int(math.Abs((wF-float64(rW))*0.5)), int(math.Abs((hF-float64(rH))*0.5)), padColor, isPNG || isWebp)
 		break
 	case mfit:
 		ratio := math.Max(wR, hR)
@@ -91,7 +97,14 @@ func ResizeImage(buffer []byte, resizeWidth, resizeHeight *int64, resizeMode *Im
 		rW := uint(sWF * ratio)
 		rH := uint(sHF * ratio)
 		imgSrc = resize.Resize(rW, rH, imgSrc, resize.NearestNeighbor)
-		imgSrc = _cropImage(imgSrc, w, h, int(math.Abs((wF-float64(rW))*0.5)), int(math.Abs((hF-float64(rH))*0.5)))
+		x := int(math.Abs((wF - float64(rW)) * 0.5))
+		y := int(math.Abs((hF - float64(rH)) * 0.5))
+		if gravity != nil && *gravity == autoGravity {
+			x, y = _computeSmartCropPosition(imgSrc, w, h)
+		} else if gravity != nil {
+			x, y = _computeGravityPosition(int(rW), int(rH), w, h, 0, 0, *gravity)
+		}
+		imgSrc = _cropImage(imgSrc, w, h, x, y)
 		break
 	}
 
@@ -124,7 +137,106 @@ func ResizeImage(buffer []byte, resizeWidth, resizeHeight *int64, resizeMode *Im
 	return _saveImage(buffer, imgSrc, isPNG, isJPEG, isGIF, isBMP, isWebp)
 }
 
-func drawWrap(src image.Image, w int, h int, x int, y int, padColor *color.RGBA) image.Image {
+// _decodeJpegForResize decodes the JPEG at 1/2, 1/4 or 1/8 of its size when that still covers the resized size,
+// and returns the full size. nil means the image has to be decoded normally.
+func _decodeJpegForResize(buffer []byte, w, h int, m ImageResizeMode, isJPEG bool) (image.Image, int, int) {
+	if !isJPEG {
+		return nil, 0, 0
+	}
+	if !_isSequentialJpeg(buffer) { // progressive and arithmetic coding take the normal decoder
+		return nil, 0, 0
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(buffer))
+	if err != nil {
+		return nil, 0, 0
+	}
+	sWF := float64(config.Width)
+	sHF := float64(config.Height)
+	rW, rH := float64(w), float64(h)
+	switch m {
+	case fixed:
+		// the resize keeps the aspect ratio for a zero side
+		if rW == 0 {
+			rW = rH * sWF / sHF
+		} else if rH == 0 {
+			rH = rW * sHF / sWF
+		}
+		break
+	case lfit, pad:
+		// a zero side makes the ratio zero, and ResizeImage keeps the full size then
+		ratio := math.Min(rW/sWF, rH/sHF)
+		rW, rH = sWF*ratio, sHF*ratio
+		break
+	case mfit, fill:
+		ratio := math.Max(rW/sWF, rH/sHF)
+		rW, rH = sWF*ratio, sHF*ratio
+		break
+	}
+	if rW <= 0 || rH <= 0 {
+		return nil, 0, 0
+	}
+
+	scale := _jpegShrinkScale(config.Width, config.Height, int(math.Ceil(rW)), int(math.Ceil(rH)))
+	if scale == 1 {
+		return nil, 0, 0
+	}
+	img, err := _decodeJpegScaled(buffer, scale)
+	if err != nil {
+		fmt.Println(err)
+		return nil, 0, 0
+	}
+	return img, config.Width, config.Height
+}
+
+func ExtendImage(buffer []byte, top, right, bottom, left *int64, padColor *color.RGBA, simpleType string) []byte {
+	var t, r, b, l int
+	if top != nil {
+		t = int(*top)
+	}
+	if right != nil {
+		r = int(*right)
+	}
+	if bottom != nil {
+		b = int(*bottom)
+	}
+	if left != nil {
+		l = int(*left)
+	}
+	if t == 0 && r == 0 && b == 0 && l == 0 {
+		return buffer
+	}
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	col := color.RGBA{
+		A: 255,
+		R: 255,
+		G: 255,
+		B: 255,
+	}
+	if padColor != nil {
+		col = *padColor
+	}
+
+	bounds := imgSrc.Bounds()
+	imgSrc = drawWrap(imgSrc, bounds.Dx()+l+r, bounds.Dy()+t+b, l, t, &col, isPNG || isWebp)
+
+	return _saveImage(buffer, imgSrc, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+// drawWrap places src at x, y on a w*h canvas of padColor. Without keepAlpha the output format has no alpha, so a
+// translucent padColor is flattened on white instead of turning black.
+func drawWrap(src image.Image, w int, h int, x int, y int, padColor *color.RGBA, keepAlpha bool) image.Image {
 	wrapImg := image.NewRGBA(image.Rect(0, 0, w, h))
 	var col color.RGBA
 	if padColor == nil {
@@ -134,12 +246,14 @@ func drawWrap(src image.Image, w int, h int, x int, y int, padColor *color.RGBA)
 			G: 0,
 			B: 0,
 		}
+	} else if keepAlpha {
+		col = _premultiplyColor(*padColor)
 	} else {
-		col = *padColor
+		col = _flattenColor(*padColor)
 	}
 	draw.Draw(wrapImg, wrapImg.Bounds(), &image.Uniform{C: col}, image.Point{}, draw.Src)
 	bounds := src.Bounds()
 	p := image.Pt(x, y)
-	draw.Draw(wrapImg, bounds.Add(p), src, bounds.Min, draw.Src)
+	draw.Draw(wrapImg, image.Rect(0, 0, bounds.Dx(), bounds.Dy()).Add(p), src, bounds.Min, draw.Src)
 	return wrapImg
 }
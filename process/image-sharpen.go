@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"image"
-	"image/color"
+	"math"
 )
 
 func SharpenImage(buffer []byte, sharpenValue *int64, simpleType string) []byte {
@@ -17,88 +17,73 @@ func SharpenImage(buffer []byte, sharpenValue *int64, simpleType string) []byte
 		return buffer
 	}
 
+	// the OSS sharpen value becomes the amount of a fine unsharp mask
+	radius := defSharpenRadius
+	amount := float64(v) / 100
+	threshold := int64(defSharpenThreshold)
+	return UnsharpMaskImage(buffer, &radius, &amount, &threshold, simpleType)
+}
+
+func UnsharpMaskImage(buffer []byte, usmRadius, usmAmount *float64, usmThreshold *int64, simpleType string) []byte {
 	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
 
 	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
 		return buffer
 	}
 
+	radius := float64(defUsmRadius)
+	amount := float64(defUsmAmount)
+	threshold := defUsmThreshold
+	if usmRadius != nil {
+		radius = *usmRadius
+	}
+	if usmAmount != nil {
+		amount = *usmAmount
+	}
+	if usmThreshold != nil {
+		threshold = int(*usmThreshold)
+	}
+	if radius <= 0 || amount <= 0 {
+		return buffer
+	}
+
 	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
 	if err != nil {
 		fmt.Println(err)
 		return buffer
 	}
 
-	bounds := imgSrc.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	imgTmp := image.NewRGBA(bounds)
-
-	_laplacianSharpen(imgSrc, imgTmp, width, height, int32(v))
+	imgTmp := _unsharpMask(_toRGBA(imgSrc), radius, amount, threshold)
 
 	return _saveImage(buffer, imgTmp, isPNG, isJPEG, isGIF, isBMP, isWebp)
 }
 
-func _parseColor(src image.Image, x int, y int) (int, int, int, int) {
-	r0, g0, b0, a0 := src.At(x, y).RGBA()
-	r := int(r0 >> 8)
-	g := int(g0 >> 8)
-	b := int(b0 >> 8)
-	a := int(a0 >> 8)
-	return r, g, b, a
-}
-
-func _laplacianSharpen(src image.Image, tmp *image.RGBA, width, height int, sharpen int32) {
-	maxHeight := height - 1
-	maxWidth := width - 1
+// _unsharpMask adds amount times the difference to a gaussian blur of the given radius (sigma),
+// differences not above threshold are left alone so flat areas do not get noisy
+func _unsharpMask(src *image.RGBA, radius, amount float64, threshold int) *image.RGBA {
+	blur := _gaussianBlur(src, int(math.Ceil(radius*3)), radius)
+	bounds := blur.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	dst := image.NewRGBA(bounds)
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
-			r, g, b, a := _parseColor(src, x, y)
-			if y > 0 && y < maxHeight && x > 0 && x < maxWidth {
-				var rChannel []int
-				var gChannel []int
-				var bChannel []int
-				for x0 := -1; x0 < 2; x0++ {
-					for y0 := -1; y0 < 2; y0++ {
-						r0, g0, b0, _ := _parseColor(src, x0+x, y0+y)
-						rChannel = append(rChannel, r0)
-						gChannel = append(gChannel, g0)
-						bChannel = append(bChannel, b0)
-					}
+			s := y*src.Stride + x*4
+			d := y*dst.Stride + x*4
+			a := src.Pix[s+3]
+			for k := 0; k < 3; k++ {
+				c := int32(src.Pix[s+k])
+				diff := c - int32(blur.Pix[d+k])
+				if diff > int32(threshold) || -diff > int32(threshold) {
+					c += int32(math.Round(float64(diff) * amount))
 				}
-				r = __laplacianSharpen(rChannel, sharpen, 15)
-				g = __laplacianSharpen(gChannel, sharpen, 15)
-				b = __laplacianSharpen(bChannel, sharpen, 15)
-			}
-			col := color.RGBA{
-				A: uint8(a),
-				R: _fixColor(int32(r)),
-				G: _fixColor(int32(g)),
-				B: _fixColor(int32(b)),
+				if c > int32(a) {
+					c = int32(a)
+				}
+				dst.Pix[d+k] = _fixColor(c)
 			}
-			tmp.SetRGBA(x, y, col)
+			dst.Pix[d+3] = a
 		}
 	}
-}
-
-func __laplacianSharpen(channel []int, sharpen, threshold int32) int {
-	gaussianMat := []int{
-		1, 2, 1, 2, 4, 2, 1, 2, 1,
-	}
-
-	sum := 0
-	for i := range channel {
-		c := channel[i]
-		sum += c * gaussianMat[i]
-	}
-
-	src := channel[4]
-	blur := uint8(sum >> 4)
-	texture := int32(_fixColor(int32(src - int(blur))))
-	if texture > threshold {
-		detail := (texture * sharpen) >> 5
-		return int(_fixColor(int32(src) + detail))
-	}
-	return src
+	return dst
 }
@@ -0,0 +1,139 @@
+package process
+
+import (
+	"github.com/nfnt/resize"
+	"image"
+	"math"
+)
+
+const (
+	smartCropAnalyzeSize   = 256
+	smartCropSteps         = 24
+	smartCropEntropyBins   = 16
+	smartCropEdgeWeight    = 1.0
+	smartCropSkinWeight    = 0.6
+	smartCropSatWeight     = 0.3
+	smartCropEntropyWeight = 0.4
+)
+
+// _computeSmartCropPosition picks the w*h window with the most detail: edge density, skin tones, saturation and
+// luminance entropy are scored on a downscaled copy, the window with the highest total wins.
+func _computeSmartCropPosition(imgSrc image.Image, w, h int) (int, int) {
+	bounds := imgSrc.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	if w >= width && h >= height {
+		return 0, 0
+	}
+
+	scale := math.Min(1, float64(smartCropAnalyzeSize)/math.Max(float64(width), float64(height)))
+	aW := int(math.Max(1, math.Round(float64(width)*scale)))
+	aH := int(math.Max(1, math.Round(float64(height)*scale)))
+	analyze := imgSrc
+	if scale < 1 {
+		analyze = resize.Resize(uint(aW), uint(aH), imgSrc, resize.Bilinear)
+	}
+	img := _toNRGBA(analyze)
+	aW = img.Bounds().Dx()
+	aH = img.Bounds().Dy()
+
+	luma := make([]float64, aW*aH)
+	detail := make([]float64, (aW+1)*(aH+1))                  // integral of the per pixel score
+	bins := make([]int32, (aW+1)*(aH+1)*smartCropEntropyBins) // integral histograms of luma
+	for y := 0; y < aH; y++ {
+		for x := 0; x < aW; x++ {
+			i := y*img.Stride + x*4
+			p := img.Pix[i : i+4 : i+4]
+			luma[y*aW+x] = _computeLuma(float64(p[0]), float64(p[1]), float64(p[2])) / 255 * float64(p[3]) / 255
+		}
+	}
+	for y := 0; y < aH; y++ {
+		rowScore := 0.0
+		var rowBins [smartCropEntropyBins]int32
+		for x := 0; x < aW; x++ {
+			i := y*img.Stride + x*4
+			p := img.Pix[i : i+4 : i+4]
+			alpha := float64(p[3]) / 255
+			score := smartCropEdgeWeight*_sobelMagnitude(luma, aW, aH, x, y) +
+				smartCropSkinWeight*_skinScore(p[0], p[1], p[2]) +
+				smartCropSatWeight*_saturationScore(p[0], p[1], p[2])
+			rowScore += score * alpha
+			rowBins[int(luma[y*aW+x]*(smartCropEntropyBins-1)+0.5)] += 1
+
+			j := (y+1)*(aW+1) + x + 1
+			detail[j] = detail[j-aW-1] + rowScore
+			for k := 0; k < smartCropEntropyBins; k++ {
+				bins[j*smartCropEntropyBins+k] = bins[(j-aW-1)*smartCropEntropyBins+k] + rowBins[k]
+			}
+		}
+	}
+
+	wA := int(math.Max(1, math.Min(float64(aW), math.Round(float64(w)*float64(aW)/float64(width)))))
+	hA := int(math.Max(1, math.Min(float64(aH), math.Round(float64(h)*float64(aH)/float64(height)))))
+	stepX := int(math.Max(1, float64(aW-wA)/smartCropSteps))
+	stepY := int(math.Max(1, float64(aH-hA)/smartCropSteps))
+	area := float64(wA * hA)
+
+	bestX, bestY := (aW-wA)/2, (aH-hA)/2
+	bestScore := math.Inf(-1)
+	for y := 0; y <= aH-hA; y += stepY {
+		for x := 0; x <= aW-wA; x += stepX {
+			x1, y1 := x+wA, y+hA
+			sum := detail[y1*(aW+1)+x1] - detail[y*(aW+1)+x1] - detail[y1*(aW+1)+x] + detail[y*(aW+1)+x]
+			entropy := 0.0
+			for k := 0; k < smartCropEntropyBins; k++ {
+				n := bins[(y1*(aW+1)+x1)*smartCropEntropyBins+k] - bins[(y*(aW+1)+x1)*smartCropEntropyBins+k] -
+					bins[(y1*(aW+1)+x)*smartCropEntropyBins+k] + bins[(y*(aW+1)+x)*smartCropEntropyBins+k]
+				if n > 0 {
+					q := float64(n) / area
+					entropy -= q * math.Log2(q)
+				}
+			}
+			score := sum/area + smartCropEntropyWeight*entropy/math.Log2(smartCropEntropyBins)
+			if score > bestScore {
+				bestScore = score
+				bestX, bestY = x, y
+			}
+		}
+	}
+
+	cX := int(math.Round(float64(bestX) * float64(width) / float64(aW)))
+	cY := int(math.Round(float64(bestY) * float64(height) / float64(aH)))
+	cX = int(math.Max(0, math.Min(float64(width-w), float64(cX))))
+	cY = int(math.Max(0, math.Min(float64(height-h), float64(cY))))
+	return cX, cY
+}
+
+func _sobelMagnitude(luma []float64, w, h, x, y int) float64 {
+	at := func(tX, tY int) float64 {
+		tX = int(math.Max(0, math.Min(float64(w-1), float64(tX))))
+		tY = int(math.Max(0, math.Min(float64(h-1), float64(tY))))
+		return luma[tY*w+tX]
+	}
+	gX := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+	gY := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+	return math.Min(1, math.Hypot(gX, gY)/4)
+}
+
+// _skinScore how close the color is to the usual skin tone range in YCbCr
+func _skinScore(r, g, b uint8) float64 {
+	rF, gF, bF := float64(r), float64(g), float64(b)
+	y := 0.299*rF + 0.587*gF + 0.114*bF
+	if y < 40 || y > 240 {
+		return 0
+	}
+	cb := 128 - 0.168736*rF - 0.331264*gF + 0.5*bF
+	cr := 128 + 0.5*rF - 0.418688*gF - 0.081312*bF
+	// distance to the center of the skin cluster, normalized by its spread
+	d := math.Hypot((cb-102)/25, (cr-153)/20)
+	return math.Max(0, 1-d)
+}
+
+func _saturationScore(r, g, b uint8) float64 {
+	max := math.Max(float64(r), math.Max(float64(g), float64(b)))
+	min := math.Min(float64(r), math.Min(float64(g), float64(b)))
+	if max == 0 {
+		return 0
+	}
+	return (max - min) / max
+}
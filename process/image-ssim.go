@@ -0,0 +1,110 @@
+package process
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	ssimWindowRadius = 5
+	ssimWindowSigma  = 1.5
+	// images are averaged down to about this size on the short side first, as the SSIM paper suggests
+	ssimAnalyzeSize = 256
+	ssimC1          = (0.01 * 255) * (0.01 * 255)
+	ssimC2          = (0.03 * 255) * (0.03 * 255)
+)
+
+// _computeSsim returns the mean structural similarity of the luminance of two images of the same size, 1 means
+// identical. Images of different sizes score 0.
+func _computeSsim(ref, img image.Image) float64 {
+	rBounds := ref.Bounds()
+	iBounds := img.Bounds()
+	if rBounds.Dx() != iBounds.Dx() || rBounds.Dy() != iBounds.Dy() || rBounds.Empty() {
+		return 0
+	}
+
+	factor := int(math.Max(1, math.Round(math.Min(float64(rBounds.Dx()), float64(rBounds.Dy()))/ssimAnalyzeSize)))
+	x, w, h := _ssimLumaPlane(ref, factor)
+	y, _, _ := _ssimLumaPlane(img, factor)
+
+	n := w * h
+	xx := make([]float64, n)
+	yy := make([]float64, n)
+	xy := make([]float64, n)
+	for i := 0; i < n; i++ {
+		xx[i] = x[i] * x[i]
+		yy[i] = y[i] * y[i]
+		xy[i] = x[i] * y[i]
+	}
+
+	kernel := _gaussianKernel(ssimWindowRadius, ssimWindowSigma)
+	muX := _blurPlane(x, w, h, kernel)
+	muY := _blurPlane(y, w, h, kernel)
+	sXX := _blurPlane(xx, w, h, kernel)
+	sYY := _blurPlane(yy, w, h, kernel)
+	sXY := _blurPlane(xy, w, h, kernel)
+
+	sum := 0.0
+	for i := 0; i < n; i++ {
+		mX, mY := muX[i], muY[i]
+		varX := sXX[i] - mX*mX
+		varY := sYY[i] - mY*mY
+		cov := sXY[i] - mX*mY
+		sum += ((2*mX*mY + ssimC1) * (2*cov + ssimC2)) / ((mX*mX + mY*mY + ssimC1) * (varX + varY + ssimC2))
+	}
+	return sum / float64(n)
+}
+
+// _ssimLumaPlane averages factor*factor blocks of the premultiplied luminance
+func _ssimLumaPlane(imgSrc image.Image, factor int) ([]float64, int, int) {
+	img := _toRGBA(imgSrc)
+	bounds := img.Bounds()
+	w := bounds.Dx() / factor
+	h := bounds.Dy() / factor
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	plane := make([]float64, w*h)
+	for y := 0; y < h*factor && y < bounds.Dy(); y++ {
+		for x := 0; x < w*factor && x < bounds.Dx(); x++ {
+			i := y*img.Stride + x*4
+			plane[(y/factor)*w+x/factor] += _computeLuma(float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2]))
+		}
+	}
+	area := float64(factor * factor)
+	for i := range plane {
+		plane[i] /= area
+	}
+	return plane, w, h
+}
+
+// _blurPlane separable convolution of a single channel, edges are clamped
+func _blurPlane(src []float64, w, h int, kernel []float64) []float64 {
+	radius := len(kernel) / 2
+	tmp := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := 0.0
+			for k := -radius; k <= radius; k++ {
+				sX := int(math.Max(0, math.Min(float64(w-1), float64(x+k))))
+				c += src[y*w+sX] * kernel[k+radius]
+			}
+			tmp[y*w+x] = c
+		}
+	}
+	dst := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := 0.0
+			for k := -radius; k <= radius; k++ {
+				sY := int(math.Max(0, math.Min(float64(h-1), float64(y+k))))
+				c += tmp[sY*w+x] * kernel[k+radius]
+			}
+			dst[y*w+x] = c
+		}
+	}
+	return dst
+}
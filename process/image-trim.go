@@ -0,0 +1,117 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+func TrimImage(buffer []byte, tolerance *int64, trimColor *color.RGBA, padding *int64, simpleType string) []byte {
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	t := defTrimTolerance
+	if tolerance != nil {
+		t = int(*tolerance)
+	}
+	p := 0
+	if padding != nil {
+		p = int(*padding)
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	rect, ok := _computeTrimBounds(_toNRGBA(imgSrc), t, trimColor)
+	if !ok { // nothing but background
+		return buffer
+	}
+
+	bounds := imgSrc.Bounds()
+	rect = image.Rect(rect.Min.X-p, rect.Min.Y-p, rect.Max.X+p, rect.Max.Y+p).Intersect(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if rect.Dx() == bounds.Dx() && rect.Dy() == bounds.Dy() {
+		return buffer
+	}
+
+	cropImg := _cropImage(imgSrc, rect.Dx(), rect.Dy(), rect.Min.X, rect.Min.Y)
+	if cropImg == nil {
+		return buffer
+	}
+
+	return _saveImage(buffer, cropImg, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+// _computeTrimBounds finds the bounding box of the pixels that differ from the background by more than tolerance.
+// Without a color the background is the top left pixel, a transparent background matches every nearly transparent pixel.
+func _computeTrimBounds(img *image.NRGBA, tolerance int, trimColor *color.RGBA) (image.Rectangle, bool) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	if width == 0 || height == 0 {
+		return image.Rectangle{}, false
+	}
+
+	var bg color.NRGBA
+	if trimColor != nil {
+		bg = color.NRGBA(*trimColor)
+	} else {
+		bg = img.NRGBAAt(0, 0)
+	}
+
+	isBackground := func(x, y int) bool {
+		i := y*img.Stride + x*4
+		p := img.Pix[i : i+4 : i+4]
+		if bg.A == 0 || int(p[3]) <= tolerance && int(bg.A) <= tolerance {
+			return int(p[3]) <= tolerance
+		}
+		d := math.Max(math.Abs(float64(p[0])-float64(bg.R)), math.Abs(float64(p[1])-float64(bg.G)))
+		d = math.Max(d, math.Abs(float64(p[2])-float64(bg.B)))
+		d = math.Max(d, math.Abs(float64(p[3])-float64(bg.A)))
+		return int(d) <= tolerance
+	}
+	isBackgroundRow := func(y, x0, x1 int) bool {
+		for x := x0; x < x1; x++ {
+			if !isBackground(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	isBackgroundColumn := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if !isBackground(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	top := 0
+	for top < height && isBackgroundRow(top, 0, width) {
+		top++
+	}
+	if top == height {
+		return image.Rectangle{}, false
+	}
+	bottom := height
+	for bottom > top && isBackgroundRow(bottom-1, 0, width) {
+		bottom--
+	}
+	left := 0
+	for left < width && isBackgroundColumn(left, top, bottom) {
+		left++
+	}
+	right := width
+	for right > left && isBackgroundColumn(right-1, top, bottom) {
+		right--
+	}
+	return image.Rect(left, top, right, bottom), true
+}
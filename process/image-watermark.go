@@ -0,0 +1,294 @@
+package process
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	fixedpoint "golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// watermarkFontLock guards the directory, and keeps fonts of an old directory out of the cache
+	watermarkFontLock      sync.RWMutex
+	watermarkFontDirectory string
+	watermarkFontCache     sync.Map
+)
+
+// SetWatermarkFontDirectory sets the local directory the text watermark fonts (ttf, otf, ttc) are loaded from.
+// Without it, or when the default font is missing, the bundled Go font is used.
+func SetWatermarkFontDirectory(dir string) {
+	watermarkFontLock.Lock()
+	defer watermarkFontLock.Unlock()
+	watermarkFontDirectory = dir
+	watermarkFontCache.Range(func(key, _ interface{}) bool {
+		watermarkFontCache.Delete(key)
+		return true
+	})
+}
+
+func WatermarkImage(buffer []byte, bucket string, watermark *ImageWatermarkInfo, textColor *color.RGBA, gravity *ImageGravity, marginX, marginY *int64, simpleType string) []byte {
+	if watermark == nil || (watermark.Text == nil && watermark.Image == nil) {
+		return buffer
+	}
+
+	isPNG, isJPEG, isBMP, isGIF, isWebp := checkImageType(simpleType)
+
+	if !(isPNG || isJPEG || isGIF || isBMP || isWebp) { // not support type
+		return buffer
+	}
+
+	imgSrc, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		fmt.Println(err)
+		return buffer
+	}
+
+	var layers []image.Image
+	if watermark.Image != nil {
+		layer, err := _drawWatermarkImage(bucket, watermark, imgSrc.Bounds())
+		if err != nil {
+			fmt.Println(err)
+			return buffer
+		}
+		layers = append(layers, layer)
+	}
+	if watermark.Text != nil {
+		layer, err := _drawWatermarkText(watermark, textColor)
+		if err != nil {
+			fmt.Println(err)
+			return buffer
+		}
+		layers = append(layers, layer)
+	}
+
+	g := southEast
+	if gravity != nil {
+		g = *gravity
+	}
+	x := defWatermarkMargin
+	y := defWatermarkMargin
+	if marginX != nil {
+		x = int(*marginX)
+	}
+	if marginY != nil {
+		y = int(*marginY)
+	}
+
+	render := _drawWatermarkLayer(imgSrc, _joinWatermarkLayers(layers), g, x, y, watermark.Fill)
+
+	return _saveImage(buffer, render, isPNG, isJPEG, isGIF, isBMP, isWebp)
+}
+
+// _joinWatermarkLayers puts the image and text layers side by side, vertically centered
+func _joinWatermarkLayers(layers []image.Image) image.Image {
+	if len(layers) == 1 {
+		return layers[0]
+	}
+	w := 0
+	h := 0
+	for i := range layers {
+		bounds := layers[i].Bounds()
+		w += bounds.Dx()
+		h = int(math.Max(float64(h), float64(bounds.Dy())))
+	}
+	joined := image.NewRGBA(image.Rect(0, 0, w, h))
+	left := 0
+	for i := range layers {
+		bounds := layers[i].Bounds()
+		top := (h - bounds.Dy()) / 2
+		draw.Draw(joined, image.Rect(left, top, left+bounds.Dx(), top+bounds.Dy()), layers[i], bounds.Min, draw.Src)
+		left += bounds.Dx()
+	}
+	return joined
+}
+
+func _drawWatermarkImage(bucket string, watermark *ImageWatermarkInfo, srcBounds image.Rectangle) (image.Image, error) {
+	overlay, err := fetchImage(bucket, *watermark.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	if watermark.ImagePercent != nil { // scale relative to the main image
+		bounds := overlay.Bounds()
+		p := float64(*watermark.ImagePercent) / 100
+		ratio := math.Min(float64(srcBounds.Dx())*p/float64(bounds.Dx()), float64(srcBounds.Dy())*p/float64(bounds.Dy()))
+		w := uint(math.Max(1, float64(bounds.Dx())*ratio))
+		h := uint(math.Max(1, float64(bounds.Dy())*ratio))
+		overlay = resize.Resize(w, h, overlay, resize.Bilinear)
+	}
+
+	bounds := overlay.Bounds()
+	layer := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	opacity := uint8(255)
+	if watermark.Opacity != nil {
+		opacity = uint8(*watermark.Opacity * 255 / 100)
+	}
+	draw.DrawMask(layer, layer.Bounds(), overlay, bounds.Min, &image.Uniform{C: color.Alpha{A: opacity}}, image.Point{}, draw.Src)
+	return layer, nil
+}
+
+func _drawWatermarkLayer(imgSrc image.Image, layer image.Image, gravity ImageGravity, x, y int, fill bool) *image.RGBA {
+	bounds := imgSrc.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	render := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(render, render.Bounds(), imgSrc, bounds.Min, draw.Src)
+
+	lBounds := layer.Bounds()
+	lW := lBounds.Dx()
+	lH := lBounds.Dy()
+	if lW == 0 || lH == 0 {
+		return render
+	}
+
+	if fill { // tile the layer over the whole image, margins are the spacing between tiles
+		for top := 0; top < height; top += lH + y {
+			for left := 0; left < width; left += lW + x {
+				draw.Draw(render, image.Rect(left, top, left+lW, top+lH), layer, lBounds.Min, draw.Over)
+			}
+		}
+		return render
+	}
+
+	left, top := _computeGravityPosition(width, height, lW, lH, x, y, gravity)
+	draw.Draw(render, image.Rect(left, top, left+lW, top+lH), layer, lBounds.Min, draw.Over)
+	return render
+}
+
+func _drawWatermarkText(watermark *ImageWatermarkInfo, textColor *color.RGBA) (image.Image, error) {
+	fontType := ""
+	if watermark.FontType != nil {
+		fontType = *watermark.FontType
+	}
+	fnt, err := _loadWatermarkFont(fontType)
+	if err != nil {
+		return nil, err
+	}
+
+	size := float64(defWatermarkFontSize)
+	if watermark.FontSize != nil {
+		size = float64(*watermark.FontSize)
+	}
+	face, err := opentype.NewFace(fnt, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingNone,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	text := *watermark.Text
+	textBounds, _ := font.BoundString(face, text)
+	tW := (textBounds.Max.X - textBounds.Min.X).Ceil()
+	tH := (textBounds.Max.Y - textBounds.Min.Y).Ceil()
+	if tW <= 0 || tH <= 0 {
+		return nil, errors.New("watermark text has no visible glyph")
+	}
+
+	shadowOffset := 0
+	if watermark.Shadow != nil && *watermark.Shadow > 0 {
+		shadowOffset = int(math.Max(1, size/20))
+	}
+	// size_ and the text length are not bounded on their own, the layer is
+	if (tW+shadowOffset)*(tH+shadowOffset) > defWatermarkMaxPixels {
+		return nil, errors.New("watermark text is too large")
+	}
+
+	mask := image.NewAlpha(image.Rect(0, 0, tW, tH))
+	drawer := &font.Drawer{
+		Dst:  mask,
+		Src:  image.Opaque,
+		Face: face,
+		Dot:  fixedpoint.Point26_6{X: -textBounds.Min.X, Y: -textBounds.Min.Y},
+	}
+	drawer.DrawString(text)
+
+	opacity := uint8(255)
+	if watermark.Opacity != nil {
+		opacity = uint8(*watermark.Opacity * 255 / 100)
+	}
+	col := color.NRGBA{A: 255}
+	if textColor != nil {
+		col = color.NRGBA{R: textColor.R, G: textColor.G, B: textColor.B, A: textColor.A}
+	}
+	col.A = uint8(int(col.A) * int(opacity) / 255)
+
+	layer := image.NewRGBA(image.Rect(0, 0, tW+shadowOffset, tH+shadowOffset))
+	if shadowOffset > 0 {
+		shadow := color.NRGBA{A: uint8(int64(opacity) * *watermark.Shadow / 100)}
+		draw.DrawMask(layer, mask.Bounds().Add(image.Pt(shadowOffset, shadowOffset)), &image.Uniform{C: shadow}, image.Point{}, mask, image.Point{}, draw.Over)
+	}
+	draw.DrawMask(layer, mask.Bounds(), &image.Uniform{C: col}, image.Point{}, mask, image.Point{}, draw.Over)
+
+	if watermark.Rotate != nil && *watermark.Rotate%360 != 0 {
+		return _rotateImage(layer, float64(*watermark.Rotate), color.RGBA{}, bilinearInterpolation), nil
+	}
+	return layer, nil
+}
+
+func _loadWatermarkFont(fontType string) (*sfnt.Font, error) {
+	name := fontType
+	if name == "" {
+		name = defWatermarkFontType
+	}
+	watermarkFontLock.RLock()
+	defer watermarkFontLock.RUnlock()
+	if fnt, ok := watermarkFontCache.Load(name); ok {
+		return fnt.(*sfnt.Font), nil
+	}
+
+	fnt, err := _readWatermarkFont(name)
+	if err != nil {
+		if fontType != "" { // requested font is missing
+			return nil, err
+		}
+		fnt, err = opentype.Parse(goregular.TTF)
+		if err != nil {
+			return nil, err
+		}
+	}
+	watermarkFontCache.Store(name, fnt)
+	return fnt, nil
+}
+
+func _readWatermarkFont(name string) (*sfnt.Font, error) {
+	if watermarkFontDirectory == "" {
+		return nil, fmt.Errorf("watermark font directory is not set, can not load font %s", name)
+	}
+	name = filepath.Base(filepath.Clean("/" + name))
+	for _, ext := range []string{"", ".ttf", ".otf", ".ttc"} {
+		path := filepath.Join(watermarkFontDirectory, name+ext)
+		if stat, err := os.Stat(path); err != nil || stat.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Ext(path) == ".ttc" {
+			collection, err := opentype.ParseCollection(buf)
+			if err != nil {
+				return nil, err
+			}
+			return collection.Font(0)
+		}
+		return opentype.Parse(buf)
+	}
+	return nil, fmt.Errorf("watermark font %s not found", name)
+}
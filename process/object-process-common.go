@@ -4,6 +4,8 @@ import (
 	"image"
 	"image/color"
 	"math"
+	"sync"
+	"time"
 )
 
 // ObjectTypeInfo
@@ -25,23 +27,52 @@ func (rc *roundedCorner) Bounds() image.Rectangle {
 }
 
 func (rc *roundedCorner) At(x, y int) color.Color {
-	r := rc.Radius
-	if r == 0 {
-		return color.Alpha{A: 255}
+	// signed distance from the pixel center to the edge, negative inside, covers the pixel partly within 0.5
+	pX := float64(x) + 0.5
+	pY := float64(y) + 0.5
+	w := float64(rc.Width)
+	h := float64(rc.Height)
+	d := -1.0
+	if rc.Ellipse {
+		d = _ellipseDistance(pX-w*0.5, pY-h*0.5, w*0.5, h*0.5)
+	} else {
+		var r, cX, cY float64
+		switch {
+		case pX < w*0.5 && pY < h*0.5: // top left
+			r = float64(rc.TopLeft)
+			cX, cY = r, r
+			break
+		case pY < h*0.5: // top right
+			r = float64(rc.TopRight)
+			cX, cY = w-r, r
+			break
+		case pX < w*0.5: // bottom left
+			r = float64(rc.BottomLeft)
+			cX, cY = r, h-r
+			break
+		default: // bottom right
+			r = float64(rc.BottomRight)
+			cX, cY = w-r, h-r
+			break
+		}
+		if r > 0 && math.Abs(pX-w*0.5) > math.Abs(cX-w*0.5) && math.Abs(pY-h*0.5) > math.Abs(cY-h*0.5) {
+			d = math.Hypot(pX-cX, pY-cY) - r
+		}
 	}
-	rF := float64(r * r)
-	w := rc.Width - 1
-	h := rc.Height - 1
-	if x < r && y < r && (rF < math.Pow(float64(r-x), 2)+math.Pow(float64(r-y), 2)) { // top left
-		return color.Alpha{A: 0}
-	} else if x > (w-r) && y < r && (rF < math.Pow(float64(w-r-x), 2)+math.Pow(float64(r-y), 2)) { // top right
-		return color.Alpha{A: 0}
-	} else if x < r && y > (h-r) && (rF < math.Pow(float64(r-x), 2)+math.Pow(float64(h-r-y), 2)) { // bottom left
-		return color.Alpha{A: 0}
-	} else if x > (w-r) && y > (h-r) && (rF < math.Pow(float64(w-r-x), 2)+math.Pow(float64(h-r-y), 2)) { // bottom right
-		return color.Alpha{A: 0}
+	return color.Alpha{A: uint8(math.Round(math.Max(0, math.Min(1, 0.5-d)) * 255))}
+}
+
+// _ellipseDistance approximates the signed distance of (x, y) to an ellipse centered at the origin
+func _ellipseDistance(x, y, a, b float64) float64 {
+	if a <= 0 || b <= 0 {
+		return 1
+	}
+	k0 := math.Hypot(x/a, y/b)
+	k1 := math.Hypot(x/(a*a), y/(b*b))
+	if k1 == 0 {
+		return -math.Min(a, b)
 	}
-	return color.Alpha{A: 255}
+	return k0 * (k0 - 1) / k1
 }
 
 func _fixColor(c int32) uint8 {
@@ -53,3 +84,72 @@ func _fixColor(c int32) uint8 {
 	}
 	return uint8(c)
 }
+
+// objectCache
+// -----------
+// Size limited in-memory cache with expiration, used for fetched objects
+type objectCache struct {
+	mutex sync.Mutex
+	items map[string]objectCacheItem
+	size  int
+	ttl   time.Duration
+}
+
+type objectCacheItem struct {
+	Value    interface{}
+	CreateAt time.Time
+}
+
+func newObjectCache(size int, ttl time.Duration) *objectCache {
+	return &objectCache{
+		items: make(map[string]objectCacheItem),
+		size:  size,
+		ttl:   ttl,
+	}
+}
+
+func (c *objectCache) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	item, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(item.CreateAt) > c.ttl {
+		delete(c.items, key)
+		return nil, false
+	}
+	return item.Value, true
+}
+
+func (c *objectCache) Set(key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.items[key]; !ok && len(c.items) >= c.size {
+		oldestKey := ""
+		var oldest time.Time
+		for k, item := range c.items {
+			if time.Since(item.CreateAt) > c.ttl {
+				delete(c.items, k)
+				continue
+			}
+			if oldestKey == "" || item.CreateAt.Before(oldest) {
+				oldestKey = k
+				oldest = item.CreateAt
+			}
+		}
+		if len(c.items) >= c.size {
+			delete(c.items, oldestKey)
+		}
+	}
+	c.items[key] = objectCacheItem{
+		Value:    value,
+		CreateAt: time.Now(),
+	}
+}
+
+func (c *objectCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.items = make(map[string]objectCacheItem)
+}
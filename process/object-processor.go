@@ -2,12 +2,16 @@ package process
 
 import (
 	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
 	"image/color"
 	"io"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // ObjectProcessInfo
@@ -16,29 +20,73 @@ import (
 type ObjectProcessInfo struct {
 	Actions []ObjectProcess
 
-	// Use on image circle or rounded-corner
+	// Format of the last format action, circle and rounded-corner keep transparency when it supports alpha
 	LastImageFormatType *ImageFormatType
+
+	// Bucket of the processed object, objects referenced by actions are fetched from it
+	Bucket string
 }
 
 type ObjectProcess struct {
 	Action ObjectProcessAction
 
-	ImageQualityMin *int64
-	ImageQualityMax *int64
+	ImageQualityMin      *int64
+	ImageQualityMax      *int64
+	ImageQualityRelative bool
+	// output size limit in KB
+	ImageTargetSize *int64
+	// downscale when even the lowest quality misses ImageTargetSize
+	ImageTargetSizeScale bool
+	// lowest SSIM against the input
+	ImageTargetSsim *float64
 
-	ImageHeight     *int64
-	ImageWidth      *int64
-	ImageColor      *color.RGBA
-	ImageResizeMode *ImageResizeMode
+	ImageHeight *int64
+	ImageWidth  *int64
+	ImageColor  *color.RGBA
+	// second color of a two-color action, e.g. the highlight of duotone
+	ImageHighlightColor *color.RGBA
+	ImageResizeMode     *ImageResizeMode
 
 	ImagePositionX *int64
 	ImagePositionY *int64
+	ImageGravity   *ImageGravity
 
 	ImageFormatType *ImageFormatType
 
-	ImageRadius *int64
+	ImageRadius            *int64
+	ImageRadiusTopLeft     *int64
+	ImageRadiusTopRight    *int64
+	ImageRadiusBottomRight *int64
+	ImageRadiusBottomLeft  *int64
+	ImageEllipse           bool
+
+	ImageMaskShape *ImageMaskShape
+	ImageMaskImage *string
+
+	ImagePadding *int64
+
+	ImageExtendTop    *int64
+	ImageExtendRight  *int64
+	ImageExtendBottom *int64
+	ImageExtendLeft   *int64
 
 	ImageValue *int64
+
+	ImageFlipMode *ImageFlipMode
+
+	ImageInterpolation *ImageInterpolation
+	ImageRotateCrop    bool
+
+	ImageSigma  *float64
+	ImageAmount *float64
+
+	ImageWatermark *ImageWatermarkInfo
+
+	ImageLutName *string
+
+	ImageEqualizeAdaptive bool
+
+	ImageRegions []ImageRegion
 }
 
 func (info *ObjectProcessInfo) IsProcessImage() bool {
@@ -65,7 +113,33 @@ func isProcessImage(action ObjectProcessAction) bool {
 		action == ImageBrightAction ||
 		action == ImageContrastAction ||
 		action == ImageRotateAction ||
-		action == ImageSharpenAction
+		action == ImageSharpenAction ||
+		action == ImageWatermarkAction ||
+		action == ImageInfoAction ||
+		action == ImageAverageHueAction ||
+		action == ImagePaletteAction ||
+		action == ImageFlipAction ||
+		action == ImageTransposeAction ||
+		action == ImageBlurAction ||
+		action == ImageUnsharpMaskAction ||
+		action == ImageSaturationAction ||
+		action == ImageHueAction ||
+		action == ImageGammaAction ||
+		action == ImageExposureAction ||
+		action == ImageGrayscaleAction ||
+		action == ImageSepiaAction ||
+		action == ImageInvertAction ||
+		action == ImageThresholdAction ||
+		action == ImageDuotoneAction ||
+		action == ImageLutAction ||
+		action == ImageAutoLevelsAction ||
+		action == ImageAutoContrastAction ||
+		action == ImageEqualizeAction ||
+		action == ImageTrimAction ||
+		action == ImageExtendAction ||
+		action == ImageMosaicAction ||
+		action == ImageBlurRegionAction ||
+		action == ImageMaskAction
 }
 
 // ObjectProcessAction
@@ -84,6 +158,32 @@ const (
 	ImageContrastAction
 	ImageRotateAction
 	ImageSharpenAction
+	ImageWatermarkAction
+	ImageInfoAction
+	ImageAverageHueAction
+	ImagePaletteAction
+	ImageFlipAction
+	ImageTransposeAction
+	ImageBlurAction
+	ImageUnsharpMaskAction
+	ImageSaturationAction
+	ImageHueAction
+	ImageGammaAction
+	ImageExposureAction
+	ImageGrayscaleAction
+	ImageSepiaAction
+	ImageInvertAction
+	ImageThresholdAction
+	ImageDuotoneAction
+	ImageLutAction
+	ImageAutoLevelsAction
+	ImageAutoContrastAction
+	ImageEqualizeAction
+	ImageTrimAction
+	ImageExtendAction
+	ImageMosaicAction
+	ImageBlurRegionAction
+	ImageMaskAction
 )
 
 func parseObjectProcessInfo(processQuery string) ObjectProcessInfo {
@@ -134,6 +234,11 @@ func parseImageProcessInfo(processParams []string, objectProcessInfo *ObjectProc
 				parseFormatImageInfo(params, info)
 				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
 				(*objectProcessInfo).LastImageFormatType = info.ImageFormatType
+				if info.ImageFormatType != nil && (*info.ImageFormatType == autoType || *info.ImageFormatType == smallestType) {
+					// auto and smallest pick a format with alpha when the image has transparency
+					t := pngType
+					(*objectProcessInfo).LastImageFormatType = &t
+				}
 				break
 			case "circle":
 				info := &ObjectProcess{
@@ -146,7 +251,14 @@ func parseImageProcessInfo(processParams []string, objectProcessInfo *ObjectProc
 				info := &ObjectProcess{
 					Action: ImageRoundedCornersCropAction,
 				}
-				parseCircleCropImageInfo(params, info)
+				parseRoundedCornersImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "mask":
+				info := &ObjectProcess{
+					Action: ImageMaskAction,
+				}
+				parseMaskImageInfo(params, info)
 				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
 				break
 			case "bright":
@@ -163,6 +275,91 @@ func parseImageProcessInfo(processParams []string, objectProcessInfo *ObjectProc
 				parseBrightImageInfo(params, info)
 				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
 				break
+			case "grayscale":
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, ObjectProcess{
+					Action: ImageGrayscaleAction,
+				})
+				break
+			case "sepia":
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, ObjectProcess{
+					Action: ImageSepiaAction,
+				})
+				break
+			case "invert":
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, ObjectProcess{
+					Action: ImageInvertAction,
+				})
+				break
+			case "threshold":
+				info := &ObjectProcess{
+					Action: ImageThresholdAction,
+				}
+				parseThresholdImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "duotone":
+				info := &ObjectProcess{
+					Action: ImageDuotoneAction,
+				}
+				parseDuotoneImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "lut":
+				info := &ObjectProcess{
+					Action: ImageLutAction,
+				}
+				parseLutImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "autolevels":
+				info := &ObjectProcess{
+					Action: ImageAutoLevelsAction,
+				}
+				parseAutoLevelsImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "autocontrast":
+				info := &ObjectProcess{
+					Action: ImageAutoContrastAction,
+				}
+				parseAutoLevelsImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "equalize":
+				info := &ObjectProcess{
+					Action: ImageEqualizeAction,
+				}
+				parseEqualizeImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "saturation":
+				info := &ObjectProcess{
+					Action: ImageSaturationAction,
+				}
+				parseBrightImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "hue":
+				info := &ObjectProcess{
+					Action: ImageHueAction,
+				}
+				parseHueImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "gamma":
+				info := &ObjectProcess{
+					Action: ImageGammaAction,
+				}
+				parseGammaImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "exposure":
+				info := &ObjectProcess{
+					Action: ImageExposureAction,
+				}
+				parseExposureImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
 			case "rotate":
 				info := &ObjectProcess{
 					Action: ImageRotateAction,
@@ -177,6 +374,91 @@ func parseImageProcessInfo(processParams []string, objectProcessInfo *ObjectProc
 				parseSharpenImageInfo(params, info)
 				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
 				break
+			case "blur":
+				info := &ObjectProcess{
+					Action: ImageBlurAction,
+				}
+				parseBlurImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "mosaic":
+				info := &ObjectProcess{
+					Action: ImageMosaicAction,
+				}
+				parseMosaicImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "blur-region":
+				info := &ObjectProcess{
+					Action: ImageBlurRegionAction,
+				}
+				parseBlurRegionImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "usm":
+				info := &ObjectProcess{
+					Action: ImageUnsharpMaskAction,
+				}
+				parseUnsharpMaskImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "watermark":
+				info := &ObjectProcess{
+					Action: ImageWatermarkAction,
+				}
+				parseWatermarkImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "border":
+				info := &ObjectProcess{
+					Action: ImageExtendAction,
+				}
+				parseBorderImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "extend":
+				info := &ObjectProcess{
+					Action: ImageExtendAction,
+				}
+				parseExtendImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "trim":
+				info := &ObjectProcess{
+					Action: ImageTrimAction,
+				}
+				parseTrimImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "flip":
+				info := &ObjectProcess{
+					Action: ImageFlipAction,
+				}
+				parseFlipImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
+			case "transpose":
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, ObjectProcess{
+					Action: ImageTransposeAction,
+				})
+				break
+			case "info":
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, ObjectProcess{
+					Action: ImageInfoAction,
+				})
+				break
+			case "average-hue":
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, ObjectProcess{
+					Action: ImageAverageHueAction,
+				})
+				break
+			case "palette":
+				info := &ObjectProcess{
+					Action: ImagePaletteAction,
+				}
+				parsePaletteImageInfo(params, info)
+				(*objectProcessInfo).Actions = append((*objectProcessInfo).Actions, *info)
+				break
 			}
 		}
 	}
@@ -218,6 +500,16 @@ func parseResizeImageInfo(params []string, info *ObjectProcess) {
 			c := hexToRGBA(*value)
 			(*info).ImageColor = &c
 			break
+		case "g":
+			if value == nil {
+				break
+			}
+			g := parseImageGravity(*value, center)
+			if *value == "auto" {
+				g = autoGravity
+			}
+			(*info).ImageGravity = &g
+			break
 		}
 	})
 }
@@ -225,9 +517,11 @@ func parseResizeImageInfo(params []string, info *ObjectProcess) {
 func parseCompressImageInfo(params []string, info *ObjectProcess) {
 	parseProcessParams(params, func(name string, value *string) {
 		switch name {
-		case "q":
-			v := *value
-			vs := strings.Split(v, "-")
+		case "q", "Q":
+			if value == nil {
+				break
+			}
+			vs := strings.Split(*value, "-")
 			min := convImageProcessParamToInt64(&(vs[0]), 100, 1, 100)
 			max := min
 			if len(vs) > 1 {
@@ -235,15 +529,28 @@ func parseCompressImageInfo(params []string, info *ObjectProcess) {
 				if max < min {
 					max, min = min, max
 				}
-			} else {
-				if min > 40 && min <= 100 {
-					min = min - 4
-				} else if min <= 40 {
-					max = min + 4
-				}
 			}
 			(*info).ImageQualityMin = &min
 			(*info).ImageQualityMax = &max
+			// q is relative to the quality of the source, Q is absolute
+			(*info).ImageQualityRelative = name == "q"
+			break
+		case "size":
+			if value == nil {
+				break
+			}
+			i := convImageProcessParamToInt64(value, 0, 1, 102400)
+			(*info).ImageTargetSize = &i
+			break
+		case "scale":
+			(*info).ImageTargetSizeScale = value != nil && *value == "1"
+			break
+		case "ssim":
+			if value == nil {
+				break
+			}
+			f := convImageProcessParamToFloat64(value, defTargetSsim, 0, 1)
+			(*info).ImageTargetSsim = &f
 			break
 		}
 	})
@@ -268,6 +575,16 @@ func parseCropImageInfo(params []string, info *ObjectProcess) {
 			i := convImageProcessParamToInt64(value, 4096, 0, 4096)
 			(*info).ImagePositionY = &i
 			break
+		case "g":
+			if value == nil {
+				break
+			}
+			g := parseImageGravity(*value, northWest)
+			if *value == "auto" {
+				g = autoGravity
+			}
+			(*info).ImageGravity = &g
+			break
 		}
 	})
 }
@@ -292,6 +609,27 @@ func parseFormatImageInfo(params []string, info *ObjectProcess) {
 		case "webp":
 			iType = webpType
 			break
+		case "auto":
+			iType = autoType
+			break
+		case "smallest":
+			iType = smallestType
+			parseProcessParams(params[1:], func(name string, value *string) {
+				if value == nil {
+					return
+				}
+				switch name {
+				case "q":
+					i := convImageProcessParamToInt64(value, defSmallestFormatQuality, 1, 100)
+					(*info).ImageQualityMax = &i
+					break
+				case "ssim":
+					f := convImageProcessParamToFloat64(value, defSmallestFormatSsim, 0, 1)
+					(*info).ImageTargetSsim = &f
+					break
+				}
+			})
+			break
 		}
 		(*info).ImageFormatType = &iType
 	}
@@ -304,6 +642,83 @@ func parseCircleCropImageInfo(params []string, info *ObjectProcess) {
 			i := convImageProcessParamToInt64(value, 0, 1, 4096)
 			(*info).ImageRadius = &i
 			break
+		case "m":
+			(*info).ImageEllipse = value != nil && *value == "ellipse"
+			break
+		case "color":
+			if value == nil {
+				break
+			}
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
+		}
+	})
+}
+
+func parseRoundedCornersImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "r":
+			i := convImageProcessParamToInt64(value, 0, 1, 4096)
+			(*info).ImageRadius = &i
+			break
+		case "tl":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageRadiusTopLeft = &i
+			break
+		case "tr":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageRadiusTopRight = &i
+			break
+		case "br":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageRadiusBottomRight = &i
+			break
+		case "bl":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageRadiusBottomLeft = &i
+			break
+		case "color":
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
+		}
+	})
+}
+
+func parseMaskImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "shape":
+			var shape ImageMaskShape
+			switch *value {
+			case "hexagon":
+				shape = hexagonMask
+				break
+			case "squircle":
+				shape = squircleMask
+				break
+			default:
+				return
+			}
+			(*info).ImageMaskShape = &shape
+			break
+		case "image":
+			if v, err := decodeProcessParamBase64(*value); err == nil && v != "" {
+				(*info).ImageMaskImage = &v
+			}
+			break
+		case "color":
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
 		}
 	})
 }
@@ -318,6 +733,119 @@ func parseBrightImageInfo(params []string, info *ObjectProcess) {
 	}
 }
 
+func parseThresholdImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "t":
+			i := convImageProcessParamToInt64(value, defThreshold, 0, 255)
+			(*info).ImageValue = &i
+			break
+		}
+	})
+}
+
+func parseDuotoneImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "shadow":
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
+		case "highlight":
+			c := hexToRGBA(*value)
+			(*info).ImageHighlightColor = &c
+			break
+		}
+	})
+}
+
+func parseLutImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "name":
+			if v, err := decodeProcessParamBase64(*value); err == nil && strings.TrimSpace(v) != "" {
+				v = strings.TrimSpace(v)
+				(*info).ImageLutName = &v
+			}
+			break
+		}
+	})
+}
+
+func parseAutoLevelsImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "p":
+			f := convImageProcessParamToFloat64(value, defAutoLevelsClip, 0, 20)
+			(*info).ImageAmount = &f
+			break
+		}
+	})
+}
+
+func parseEqualizeImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "m":
+			(*info).ImageEqualizeAdaptive = *value == "clahe"
+			break
+		case "tile":
+			i := convImageProcessParamToInt64(value, defEqualizeTiles, 1, 64)
+			(*info).ImageValue = &i
+			break
+		case "limit":
+			f := convImageProcessParamToFloat64(value, defEqualizeClipLimit, 1, 10)
+			(*info).ImageAmount = &f
+			break
+		}
+	})
+}
+
+func parseHueImageInfo(params []string, info *ObjectProcess) {
+	if len(params) > 1 {
+		n := params[1]
+		v := convImageProcessParamToInt64(&n, 0, -180, 180)
+		if v != 0 {
+			info.ImageValue = &v
+		}
+	}
+}
+
+func parseGammaImageInfo(params []string, info *ObjectProcess) {
+	if len(params) > 1 {
+		n := params[1]
+		v := convImageProcessParamToFloat64(&n, 1, 0.1, 10)
+		if v != 1 {
+			info.ImageAmount = &v
+		}
+	}
+}
+
+func parseExposureImageInfo(params []string, info *ObjectProcess) {
+	if len(params) > 1 {
+		n := params[1]
+		v := convImageProcessParamToFloat64(&n, 0, -5, 5)
+		if v != 0 {
+			info.ImageAmount = &v
+		}
+	}
+}
+
 func parseRotateImageInfo(params []string, info *ObjectProcess) {
 	if len(params) > 1 {
 		n := params[1]
@@ -326,6 +854,37 @@ func parseRotateImageInfo(params []string, info *ObjectProcess) {
 			info.ImageValue = &v
 		}
 	}
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "color":
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
+		case "i":
+			var interpolation ImageInterpolation
+			switch *value {
+			case "nearest":
+				interpolation = nearestInterpolation
+				break
+			case "bilinear":
+				interpolation = bilinearInterpolation
+				break
+			case "bicubic":
+				interpolation = bicubicInterpolation
+				break
+			default:
+				return
+			}
+			(*info).ImageInterpolation = &interpolation
+			break
+		case "m":
+			(*info).ImageRotateCrop = *value == "crop"
+			break
+		}
+	})
 }
 
 func parseSharpenImageInfo(params []string, info *ObjectProcess) {
@@ -338,6 +897,325 @@ func parseSharpenImageInfo(params []string, info *ObjectProcess) {
 	}
 }
 
+func parseBlurImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "r":
+			i := convImageProcessParamToInt64(value, defBlurRadius, 1, 50)
+			(*info).ImageRadius = &i
+			break
+		case "s":
+			i := convImageProcessParamToInt64(value, defBlurSigma, 1, 50)
+			(*info).ImageValue = &i
+			break
+		}
+	})
+}
+
+func parseMosaicImageInfo(params []string, info *ObjectProcess) {
+	parseRegionImageInfo(params, info, func(name string, value *string) {
+		switch name {
+		case "s":
+			i := convImageProcessParamToInt64(value, defMosaicBlockSize, 2, 512)
+			(*info).ImageValue = &i
+			break
+		}
+	})
+}
+
+func parseBlurRegionImageInfo(params []string, info *ObjectProcess) {
+	parseRegionImageInfo(params, info, func(name string, value *string) {
+		switch name {
+		case "r":
+			i := convImageProcessParamToInt64(value, defRegionBlurRadius, 1, 50)
+			(*info).ImageRadius = &i
+			break
+		case "s":
+			i := convImageProcessParamToInt64(value, defRegionBlurSigma, 1, 50)
+			(*info).ImageValue = &i
+			break
+		}
+	})
+}
+
+// parseRegionImageInfo collects x, y, w, h and shape into regions, a param already set on the current region starts
+// a new one. Other params are passed to processHandler.
+func parseRegionImageInfo(params []string, info *ObjectProcess, processHandler objectParamsProcessHandler) {
+	var region *ImageRegion
+	var seen map[string]bool
+	current := func(name string) *ImageRegion {
+		if region == nil || seen[name] {
+			(*info).ImageRegions = append((*info).ImageRegions, ImageRegion{})
+			region = &(*info).ImageRegions[len((*info).ImageRegions)-1]
+			seen = map[string]bool{}
+		}
+		seen[name] = true
+		return region
+	}
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "x":
+			current(name).X = convImageProcessParamToInt64(value, 0, 0, 16384)
+			break
+		case "y":
+			current(name).Y = convImageProcessParamToInt64(value, 0, 0, 16384)
+			break
+		case "w":
+			current(name).Width = convImageProcessParamToInt64(value, 0, 0, 16384)
+			break
+		case "h":
+			current(name).Height = convImageProcessParamToInt64(value, 0, 0, 16384)
+			break
+		case "shape":
+			if *value == "ellipse" {
+				current(name).Shape = ellipseRegion
+			} else {
+				current(name).Shape = rectRegion
+			}
+			break
+		default:
+			processHandler(name, value)
+			break
+		}
+	})
+}
+
+func parseUnsharpMaskImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "r":
+			f := convImageProcessParamToFloat64(value, defUsmRadius, 0.1, 50)
+			(*info).ImageSigma = &f
+			break
+		case "a":
+			f := convImageProcessParamToFloat64(value, defUsmAmount*100, 1, 500) / 100
+			(*info).ImageAmount = &f
+			break
+		case "t":
+			i := convImageProcessParamToInt64(value, defUsmThreshold, 0, 255)
+			(*info).ImageValue = &i
+			break
+		}
+	})
+}
+
+func parseBorderImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "w":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageExtendTop = &i
+			(*info).ImageExtendRight = &i
+			(*info).ImageExtendBottom = &i
+			(*info).ImageExtendLeft = &i
+			break
+		case "color":
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
+		}
+	})
+}
+
+func parseExtendImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "t":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageExtendTop = &i
+			break
+		case "r":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageExtendRight = &i
+			break
+		case "b":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageExtendBottom = &i
+			break
+		case "l":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImageExtendLeft = &i
+			break
+		case "color":
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
+		}
+	})
+}
+
+func parseTrimImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "tolerance":
+			i := convImageProcessParamToInt64(value, defTrimTolerance, 0, 255)
+			(*info).ImageValue = &i
+			break
+		case "color":
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
+		case "p":
+			i := convImageProcessParamToInt64(value, 0, 0, 4096)
+			(*info).ImagePadding = &i
+			break
+		}
+	})
+}
+
+func parseFlipImageInfo(params []string, info *ObjectProcess) {
+	if len(params) > 1 {
+		var flipMode ImageFlipMode
+		switch strings.TrimSpace(params[1]) {
+		case "h":
+			flipMode = flipHorizontal
+			break
+		case "v":
+			flipMode = flipVertical
+			break
+		case "hv", "vh":
+			flipMode = flipBoth
+			break
+		default:
+			return
+		}
+		(*info).ImageFlipMode = &flipMode
+	}
+}
+
+func parseWatermarkImageInfo(params []string, info *ObjectProcess) {
+	watermark := &ImageWatermarkInfo{}
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "text":
+			if v, err := decodeProcessParamBase64(*value); err == nil && v != "" {
+				watermark.Text = &v
+			}
+			break
+		case "type":
+			if v, err := decodeProcessParamBase64(*value); err == nil && v != "" {
+				watermark.FontType = &v
+			}
+			break
+		case "image":
+			if v, err := decodeProcessParamBase64(*value); err == nil && v != "" {
+				watermark.Image = &v
+			}
+			break
+		case "P":
+			i := convImageProcessParamToInt64(value, 0, 1, 100)
+			watermark.ImagePercent = &i
+			break
+		case "size":
+			i := convImageProcessParamToInt64(value, defWatermarkFontSize, 1, 1000)
+			watermark.FontSize = &i
+			break
+		case "t":
+			i := convImageProcessParamToInt64(value, 100, 0, 100)
+			watermark.Opacity = &i
+			break
+		case "rotate":
+			i := convImageProcessParamToInt64(value, 0, 0, 360)
+			watermark.Rotate = &i
+			break
+		case "shadow":
+			i := convImageProcessParamToInt64(value, 0, 0, 100)
+			watermark.Shadow = &i
+			break
+		case "fill":
+			watermark.Fill = *value == "1"
+			break
+		case "color":
+			c := hexToRGBA(*value)
+			(*info).ImageColor = &c
+			break
+		case "g":
+			g := parseImageGravity(*value, southEast)
+			(*info).ImageGravity = &g
+			break
+		case "x":
+			i := convImageProcessParamToInt64(value, defWatermarkMargin, 0, 4096)
+			(*info).ImagePositionX = &i
+			break
+		case "y":
+			i := convImageProcessParamToInt64(value, defWatermarkMargin, 0, 4096)
+			(*info).ImagePositionY = &i
+			break
+		}
+	})
+	(*info).ImageWatermark = watermark
+}
+
+func parsePaletteImageInfo(params []string, info *ObjectProcess) {
+	parseProcessParams(params, func(name string, value *string) {
+		if value == nil {
+			return
+		}
+		switch name {
+		case "n":
+			// libimagequant quantizes to at least 2 colors
+			i := convImageProcessParamToInt64(value, defPaletteColorCount, 2, 32)
+			(*info).ImageValue = &i
+			break
+		}
+	})
+}
+
+func parseImageGravity(value string, defaultGravity ImageGravity) ImageGravity {
+	switch value {
+	case "nw":
+		return northWest
+	case "north":
+		return north
+	case "ne":
+		return northEast
+	case "west":
+		return west
+	case "center":
+		return center
+	case "east":
+		return east
+	case "sw":
+		return southWest
+	case "south":
+		return south
+	case "se":
+		return southEast
+	}
+	return defaultGravity
+}
+
+// decodeProcessParamBase64 decodes the URL-safe base64 values OSS uses for text, font and object key params
+func decodeProcessParamBase64(value string) (string, error) {
+	v := strings.TrimRight(value, "=")
+	buf, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		buf, err = base64.RawStdEncoding.DecodeString(v)
+	}
+	return string(buf), err
+}
+
 func convImageProcessParamToInt64(value *string, defaultValue, min, max int64) int64 {
 	v := *value
 	i, err := strconv.ParseInt(v, 10, 64)
@@ -348,11 +1226,20 @@ func convImageProcessParamToInt64(value *string, defaultValue, min, max int64) i
 	return i
 }
 
+func convImageProcessParamToFloat64(value *string, defaultValue, min, max float64) float64 {
+	v := *value
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) {
+		f = defaultValue
+	}
+	return math.Min(math.Max(f, min), max)
+}
+
 type objectParamsProcessHandler func(name string, value *string)
 
 func parseProcessParams(params []string, processHandler objectParamsProcessHandler) {
 	for i := 1; i < len(params); i++ {
-		p := strings.Split(strings.TrimSpace(params[i]), "_")
+		p := strings.SplitN(strings.TrimSpace(params[i]), "_", 2)
 		if len(p) > 1 {
 			processHandler(p[0], &(p[1]))
 		} else {
@@ -392,31 +1279,103 @@ func hexToRGBA(col string) color.RGBA {
 	return c
 }
 
-func ProcessObject(objectReader io.Reader, processQuery string) (resultReader io.Reader, contentLength string, contentType string) {
-	contentLength = ""
-	contentType = ""
+// ObjectFetcher
+// -----------
+// Load another object of the bucket, e.g. the image of a watermark
+type ObjectFetcher interface {
+	FetchObject(bucket, objectKey string) (io.Reader, error)
+}
+
+var (
+	// objectFetcherLock guards the fetcher, and keeps images of an old fetcher out of the cache
+	objectFetcherLock sync.RWMutex
+	objectFetcher     ObjectFetcher
+	fetchedImageCache = newObjectCache(defFetchedImageCacheSize, defFetchedImageCacheTTL)
+)
+
+// SetObjectFetcher injects the loader used by actions that reference other objects.
+func SetObjectFetcher(fetcher ObjectFetcher) {
+	objectFetcherLock.Lock()
+	defer objectFetcherLock.Unlock()
+	objectFetcher = fetcher
+	fetchedImageCache.Clear()
+}
+
+func fetchObject(bucket, objectKey string) ([]byte, error) {
+	objectFetcherLock.RLock()
+	defer objectFetcherLock.RUnlock()
+	return _fetchObject(bucket, objectKey)
+}
+
+// _fetchObject reads the object with the fetcher, the caller holds objectFetcherLock
+func _fetchObject(bucket, objectKey string) ([]byte, error) {
+	if objectFetcher == nil {
+		return nil, errors.New("object fetcher is not set")
+	}
+	reader, err := objectFetcher.FetchObject(bucket, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return io.ReadAll(reader)
+}
+
+func fetchImage(bucket, objectKey string) (image.Image, error) {
+	cacheKey := bucket + "/" + objectKey
+	objectFetcherLock.RLock()
+	defer objectFetcherLock.RUnlock()
+	if img, ok := fetchedImageCache.Get(cacheKey); ok {
+		return img.(image.Image), nil
+	}
+	buffer, err := _fetchObject(bucket, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		return nil, err
+	}
+	fetchedImageCache.Set(cacheKey, img)
+	return img, nil
+}
+
+// ProcessObject processes the object of bucket by processQuery, objects the actions reference are fetched from the
+// same bucket. requestHeader is the header of the client request, format negotiation reads it, and may be nil.
+// responseHeader holds the headers the response should carry.
+func ProcessObject(objectReader io.Reader, bucket, processQuery string, requestHeader http.Header) (resultReader io.Reader, responseHeader http.Header) {
+	responseHeader = http.Header{}
 	resultReader = objectReader
+	if requestHeader == nil {
+		requestHeader = http.Header{}
+	}
 
 	if processQuery == "" || objectReader == nil {
 		return
 	}
 
 	processInfo := parseObjectProcessInfo(processQuery)
+	processInfo.Bucket = bucket
 
 	if !processInfo.IsProcessImage() {
 		return
 	}
 
+	contentType := ""
 	buffer, err := io.ReadAll(objectReader)
 	if err == nil { // Process object
 		objectType := checkObjectType(buffer)
 		switch {
 		case objectType.IsImage: // Process image
-			ProcessImage(processInfo, objectType, &buffer, &contentType)
+			ProcessImage(processInfo, objectType, &buffer, &contentType, requestHeader, responseHeader)
 			break
 		}
 	}
-	contentLength = strconv.FormatInt(int64(len(buffer)), 10)
+	if contentType != "" {
+		responseHeader.Set("Content-Type", contentType)
+	}
+	responseHeader.Set("Content-Length", strconv.FormatInt(int64(len(buffer)), 10))
 	resultReader = bytes.NewReader(buffer)
 	return
 }